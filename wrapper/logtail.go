@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	logTailLinesDefault  = 20
+	logTailMaxLineLength = 1024
+)
+
+func newLogTail(lines int) *logTail {
+	return &logTail{
+		lines: make([]string, 0, lines),
+		limit: lines,
+	}
+}
+
+// logTail is an io.Writer which keeps the last lines written to it.
+type logTail struct {
+	mutex   sync.Mutex
+	lines   []string
+	limit   int
+	pending []byte
+}
+
+func (lt *logTail) Write(p []byte) (int, error) {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			lt.pending = append(lt.pending, p...)
+			if len(lt.pending) > logTailMaxLineLength {
+				lt.pending = lt.pending[:logTailMaxLineLength]
+			}
+			break
+		}
+		lt.pending = append(lt.pending, p[:i]...)
+		lt.push(string(bytes.TrimRight(lt.pending, "\r")))
+		lt.pending = lt.pending[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (lt *logTail) push(line string) {
+	line = logRedactor.redact(line)
+	if len(line) > logTailMaxLineLength {
+		line = line[:logTailMaxLineLength]
+	}
+	if len(lt.lines) >= lt.limit {
+		copy(lt.lines, lt.lines[1:])
+		lt.lines = lt.lines[:len(lt.lines)-1]
+	}
+	lt.lines = append(lt.lines, line)
+}
+
+func (lt *logTail) get(n int) []string {
+	lt.mutex.Lock()
+	defer lt.mutex.Unlock()
+	if n <= 0 || n > len(lt.lines) {
+		n = len(lt.lines)
+	}
+	result := make([]string, n)
+	copy(result, lt.lines[len(lt.lines)-n:])
+	return result
+}
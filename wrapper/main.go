@@ -7,10 +7,13 @@ import (
 	"github.com/echocat/slf4g"
 	"github.com/echocat/slf4g/native"
 	_ "github.com/echocat/slf4g/native"
+	"github.com/echocat/slf4g/native/interceptor"
 	_ "github.com/echocat/slf4g/sdk/bridge/hook"
 )
 
 func main() {
+	interceptor.Default.Add(logRedactor)
+
 	var opts options
 	if err := opts.readAllDefaults(); err != nil {
 		log.WithError(err).
@@ -18,6 +21,7 @@ func main() {
 		os.Exit(21)
 	}
 
+	logRedactor.setSecrets(opts.getSecrets())
 	native.DefaultProvider.SetLevel(opts.wrapperLogLevel.get())
 
 	w, err := newWrapper(opts)
@@ -31,7 +35,7 @@ func main() {
 
 	go func() {
 		for sig := range sigs {
-			w.process.signal(sig)
+			w.signal(sig)
 		}
 	}()
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -22,14 +23,41 @@ const (
 	haInfoUrlDefault      = "http://supervisor/info"
 	haInfoUrlEnvVar       = "HA_INFO_URL"
 	supervisorTokenEnvVar = "SUPERVISOR_TOKEN"
+	ingressSourceDefault  = "172.30.32.2"
 )
 
 type options struct {
-	gui             optionsGui
-	customRelease   string
-	logLevel        optionsLogLevel
-	wrapperLogLevel optionsWrapperLogLevel
-	timezone        string
+	gui                   optionsGui
+	guiSwitcher           bool
+	customRelease         string
+	logLevel              optionsLogLevel
+	wrapperLogLevel       optionsWrapperLogLevel
+	timezone              string
+	prefixSource          optionsPrefixSource
+	prefix                string
+	trustedProxies        []string
+	ingressSources        []string
+	allowedHosts          []string
+	directAccess          bool
+	ssl                   bool
+	certFile              string
+	keyFile               string
+	tlsMinVersion         optionsTlsVersion
+	tlsClientCaFile       string
+	securityHeaders       bool
+	contentSecurityPolicy string
+	accessControl         []optionsAccessControlEntry
+	defaultRole           optionsRole
+	auditLog              bool
+	compression           bool
+	httpReadHeaderTimeout time.Duration
+	httpReadTimeout       time.Duration
+	httpWriteTimeout      time.Duration
+	httpIdleTimeout       time.Duration
+	httpMaxHeaderSize     int
+	httpMaxConnections    int
+	authRateLimit         int
+	accessLog             optionsAccessLogFormat
 
 	webservicePassword      string
 	webservicePreAuthTokens string
@@ -37,10 +65,36 @@ type options struct {
 }
 
 type optionsPayload struct {
-	Gui             optionsGui             `json:"gui,omitempty"`
-	CustomRelease   string                 `json:"custom_release,omitempty"`
-	LogLevel        optionsLogLevel        `json:"log_level,omitempty"`
-	WrapperLogLevel optionsWrapperLogLevel `json:"wrapper_log_level,omitempty"`
+	Gui                   optionsGui                  `json:"gui,omitempty"`
+	GuiSwitcher           *bool                       `json:"gui_switcher,omitempty"`
+	CustomRelease         string                      `json:"custom_release,omitempty"`
+	LogLevel              optionsLogLevel             `json:"log_level,omitempty"`
+	WrapperLogLevel       optionsWrapperLogLevel      `json:"wrapper_log_level,omitempty"`
+	PrefixSource          optionsPrefixSource         `json:"prefix_source,omitempty"`
+	Prefix                string                      `json:"prefix,omitempty"`
+	TrustedProxies        []string                    `json:"trusted_proxies,omitempty"`
+	IngressSources        []string                    `json:"ingress_sources,omitempty"`
+	AllowedHosts          []string                    `json:"allowed_hosts,omitempty"`
+	DirectAccess          bool                        `json:"direct_access,omitempty"`
+	Ssl                   bool                        `json:"ssl,omitempty"`
+	CertFile              string                      `json:"certfile,omitempty"`
+	KeyFile               string                      `json:"keyfile,omitempty"`
+	TlsMinVersion         optionsTlsVersion           `json:"tls_min_version,omitempty"`
+	TlsClientCaFile       string                      `json:"tls_client_ca_file,omitempty"`
+	SecurityHeaders       *bool                       `json:"security_headers,omitempty"`
+	ContentSecurityPolicy string                      `json:"content_security_policy,omitempty"`
+	AccessControl         []optionsAccessControlEntry `json:"access_control,omitempty"`
+	DefaultRole           optionsRole                 `json:"default_role,omitempty"`
+	AuditLog              *bool                       `json:"audit_log,omitempty"`
+	Compression           *bool                       `json:"compression,omitempty"`
+	HttpReadHeaderTimeout *int                        `json:"http_read_header_timeout,omitempty"`
+	HttpReadTimeout       *int                        `json:"http_read_timeout,omitempty"`
+	HttpWriteTimeout      *int                        `json:"http_write_timeout,omitempty"`
+	HttpIdleTimeout       *int                        `json:"http_idle_timeout,omitempty"`
+	HttpMaxHeaderSize     *int                        `json:"http_max_header_size,omitempty"`
+	HttpMaxConnections    *int                        `json:"http_max_connections,omitempty"`
+	AuthRateLimit         *int                        `json:"auth_rate_limit,omitempty"`
+	AccessLog             optionsAccessLogFormat      `json:"access_log,omitempty"`
 }
 
 type secretsPayload struct {
@@ -59,12 +113,67 @@ type haInfoPayloadData struct {
 
 func (opt *options) set(payload optionsPayload) error {
 	opt.gui = payload.Gui
+	if opt.gui == "" {
+		opt.gui = guiNgax
+	}
+	opt.guiSwitcher = payload.GuiSwitcher == nil || *payload.GuiSwitcher
 	opt.customRelease = payload.CustomRelease
 	opt.logLevel = payload.LogLevel
 	opt.wrapperLogLevel = payload.WrapperLogLevel
+	opt.prefixSource = payload.PrefixSource
+	opt.prefix = payload.Prefix
+	opt.trustedProxies = payload.TrustedProxies
+	opt.ingressSources = payload.IngressSources
+	if len(opt.ingressSources) == 0 {
+		opt.ingressSources = []string{ingressSourceDefault}
+	}
+	opt.allowedHosts = payload.AllowedHosts
+	opt.securityHeaders = payload.SecurityHeaders == nil || *payload.SecurityHeaders
+	opt.contentSecurityPolicy = payload.ContentSecurityPolicy
+	opt.accessControl = payload.AccessControl
+	opt.defaultRole = payload.DefaultRole
+	if opt.defaultRole == "" {
+		opt.defaultRole = roleAdmin
+	}
+	opt.auditLog = payload.AuditLog == nil || *payload.AuditLog
+	opt.compression = payload.Compression == nil || *payload.Compression
+	opt.httpReadHeaderTimeout = secondsOr(payload.HttpReadHeaderTimeout, httpReadHeaderTimeoutDefault)
+	opt.httpReadTimeout = secondsOr(payload.HttpReadTimeout, 0)
+	opt.httpWriteTimeout = secondsOr(payload.HttpWriteTimeout, 0)
+	opt.httpIdleTimeout = secondsOr(payload.HttpIdleTimeout, httpIdleTimeoutDefault)
+	opt.httpMaxHeaderSize = intOr(payload.HttpMaxHeaderSize, httpMaxHeaderSizeDefault/1024) * 1024
+	opt.httpMaxConnections = intOr(payload.HttpMaxConnections, httpMaxConnectionsDefault)
+	opt.authRateLimit = intOr(payload.AuthRateLimit, authRateLimitDefault)
+	opt.accessLog = payload.AccessLog
+	opt.directAccess = payload.DirectAccess
+	opt.ssl = payload.Ssl
+	opt.certFile = payload.CertFile
+	if opt.certFile == "" {
+		opt.certFile = "fullchain.pem"
+	}
+	opt.keyFile = payload.KeyFile
+	if opt.keyFile == "" {
+		opt.keyFile = "privkey.pem"
+	}
+	opt.tlsMinVersion = payload.TlsMinVersion
+	opt.tlsClientCaFile = payload.TlsClientCaFile
 	return nil
 }
 
+func intOr(v *int, def int) int {
+	if v == nil || *v < 0 {
+		return def
+	}
+	return *v
+}
+
+func secondsOr(v *int, def time.Duration) time.Duration {
+	if v == nil || *v < 0 {
+		return def
+	}
+	return time.Duration(*v) * time.Second
+}
+
 func (opt *options) setSecrets(payload secretsPayload) error {
 	opt.webservicePassword = payload.WebservicePassword
 	opt.webservicePreAuthTokens = payload.WebservicePreAuthTokens
@@ -289,9 +398,27 @@ func (opt *options) defaultHaInfoUrl() string {
 
 type optionsGui string
 
-func (ol *optionsGui) UnmarshalText(text []byte) error {
-	*ol = optionsGui(optionsGui(text).String())
-	return nil
+const (
+	guiNgax     optionsGui = "ngax"
+	guiNgclient optionsGui = "ngclient"
+)
+
+func parseOptionsGui(v string) (optionsGui, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "":
+		return "", nil
+	case "ngax":
+		return guiNgax, nil
+	case "ngclient":
+		return guiNgclient, nil
+	default:
+		return "", fmt.Errorf("unknown gui %q", v)
+	}
+}
+
+func (ol *optionsGui) UnmarshalText(text []byte) (err error) {
+	*ol, err = parseOptionsGui(string(text))
+	return err
 }
 
 func (ol optionsGui) MarshalText() ([]byte, error) {
@@ -299,18 +426,134 @@ func (ol optionsGui) MarshalText() ([]byte, error) {
 }
 
 func (ol optionsGui) String() string {
-	switch strings.ToLower(string(ol)) {
-	case "ngclient":
-		return "ngclient"
-	default:
-		return "ngax"
-	}
+	return string(ol)
 }
 
 func (ol optionsGui) initPath() string {
 	return "/" + ol.String() + "/"
 }
 
+type optionsPrefixSource string
+
+const (
+	prefixSourceIngress   optionsPrefixSource = "ingress"
+	prefixSourceForwarded optionsPrefixSource = "forwarded"
+	prefixSourceFixed     optionsPrefixSource = "fixed"
+)
+
+func parseOptionsPrefixSource(v string) (optionsPrefixSource, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "":
+		return "", nil
+	case "ingress":
+		return prefixSourceIngress, nil
+	case "forwarded", "x-forwarded-prefix":
+		return prefixSourceForwarded, nil
+	case "fixed":
+		return prefixSourceFixed, nil
+	default:
+		return "", fmt.Errorf("unknown prefix source %q", v)
+	}
+}
+
+func (ol *optionsPrefixSource) UnmarshalText(text []byte) (err error) {
+	*ol, err = parseOptionsPrefixSource(string(text))
+	return err
+}
+
+func (ol optionsPrefixSource) MarshalText() ([]byte, error) {
+	return []byte(ol.String()), nil
+}
+
+func (ol optionsPrefixSource) String() string {
+	if ol == "" {
+		return string(prefixSourceIngress)
+	}
+	return string(ol)
+}
+
+type optionsTlsVersion string
+
+func parseOptionsTlsVersion(v string) (optionsTlsVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "tls") {
+	case "":
+		return "", nil
+	case "1.2", "12":
+		return "1.2", nil
+	case "1.3", "13":
+		return "1.3", nil
+	default:
+		return "", fmt.Errorf("unknown TLS version %q", v)
+	}
+}
+
+func (ol *optionsTlsVersion) UnmarshalText(text []byte) (err error) {
+	*ol, err = parseOptionsTlsVersion(string(text))
+	return err
+}
+
+func (ol optionsTlsVersion) MarshalText() ([]byte, error) {
+	return []byte(ol.String()), nil
+}
+
+func (ol optionsTlsVersion) String() string {
+	if ol == "" {
+		return "1.2"
+	}
+	return string(ol)
+}
+
+func (ol optionsTlsVersion) get() uint16 {
+	switch ol.String() {
+	case "1.3":
+		return tls.VersionTLS13
+	default:
+		return tls.VersionTLS12
+	}
+}
+
+type optionsAccessLogFormat string
+
+const (
+	accessLogFormatNone     optionsAccessLogFormat = "none"
+	accessLogFormatCommon   optionsAccessLogFormat = "common"
+	accessLogFormatCombined optionsAccessLogFormat = "combined"
+	accessLogFormatJson     optionsAccessLogFormat = "json"
+)
+
+func parseOptionsAccessLogFormat(v string) (optionsAccessLogFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "":
+		return "", nil
+	case "none":
+		return accessLogFormatNone, nil
+	case "common", "clf":
+		return accessLogFormatCommon, nil
+	case "combined":
+		return accessLogFormatCombined, nil
+	case "json":
+		return accessLogFormatJson, nil
+	default:
+		return "", fmt.Errorf("unknown access log format %q", v)
+	}
+}
+
+func (ol *optionsAccessLogFormat) UnmarshalText(text []byte) (err error) {
+	*ol, err = parseOptionsAccessLogFormat(string(text))
+	return err
+}
+
+func (ol optionsAccessLogFormat) MarshalText() ([]byte, error) {
+	return []byte(ol.String()), nil
+}
+
+func (ol optionsAccessLogFormat) String() string {
+	if ol == "" {
+		return string(accessLogFormatNone)
+	}
+	return string(ol)
+}
+
 type optionsLogLevel string
 
 func (ol *optionsLogLevel) UnmarshalText(text []byte) error {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_optionsPayload_enums(t *testing.T) {
+	cases := []struct {
+		json  string
+		valid bool
+	}{
+		{`{"prefix_source":"forwarded"}`, true},
+		{`{"prefix_source":"Fixed"}`, true},
+		{`{"prefix_source":"forwardd"}`, false},
+		{`{"default_role":"operator"}`, true},
+		{`{"default_role":"Administrator"}`, true},
+		{`{"default_role":"admn"}`, false},
+		{`{"access_control":[{"user":"a","role":"viewer"}]}`, true},
+		{`{"access_control":[{"user":"a","role":"opertor"}]}`, false},
+		{`{"tls_min_version":"1.3"}`, true},
+		{`{"tls_min_version":"TLS1.2"}`, true},
+		{`{"tls_min_version":"1.1"}`, false},
+		{`{"access_log":"combined"}`, true},
+		{`{"access_log":"none"}`, true},
+		{`{"access_log":"jsno"}`, false},
+		{`{"gui":"ngclient"}`, true},
+		{`{"gui":"legacy"}`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.json, func(t *testing.T) {
+			var payload optionsPayload
+			err := json.Unmarshal([]byte(c.json), &payload)
+			if c.valid && err != nil {
+				t.Errorf("expected no error; but got: %v", err)
+			}
+			if !c.valid && err == nil {
+				t.Errorf("expected an error; but got: %+v", payload)
+			}
+		})
+	}
+}
+
+func Test_options_enumDefaults(t *testing.T) {
+	if actual := optionsPrefixSource("").String(); actual != string(prefixSourceIngress) {
+		t.Errorf("expected prefix source %q; but got: %q", prefixSourceIngress, actual)
+	}
+	if actual := optionsRole("").String(); actual != string(roleViewer) {
+		t.Errorf("expected role %q; but got: %q", roleViewer, actual)
+	}
+	if actual := optionsTlsVersion("").String(); actual != "1.2" {
+		t.Errorf("expected TLS version %q; but got: %q", "1.2", actual)
+	}
+	if actual := optionsAccessLogFormat("").String(); actual != string(accessLogFormatNone) {
+		t.Errorf("expected access log format %q; but got: %q", accessLogFormatNone, actual)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -27,23 +29,39 @@ const (
 	customReleaseExecutableEnvVar  = "CUSTOM_RELEASE_EXECUTABLE"
 )
 
-var (
-	background = context.Background()
-)
-
-func newProcess(opts options) (result *process, err error) {
+// newProcess does not start anything once ctx is done; the download and the
+// validation of a custom release are canceled, too.
+func newProcess(ctx context.Context, opts options, st *state) (result *process, err error) {
 	result = &process{
 		logger: log.GetLogger("duplicati"),
+		state:  st,
 	}
 
-	executable := processExecutable()
-	if opts.customRelease != "" {
-		executable, err = downloadCustomProcess(opts.customRelease)
+	executable, customRelease := processExecutable(), opts.customRelease
+	if customRelease != "" {
+		executable, err = downloadCustomProcess(ctx, customRelease)
 		if err != nil {
-			return nil, err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if previous, pErr := previousCustomProcess(ctx); pErr == nil {
+				result.logger.WithError(err).
+					With("executable", previous).
+					Error("cannot install custom release; keeping previous installed custom release")
+				executable = previous
+			} else {
+				// There was never a working custom release; so the bundled
+				// one is the previous working release.
+				executable, customRelease = processExecutable(), ""
+				result.logger.WithError(err).
+					With("executable", executable).
+					Error("cannot install custom release; keeping bundled release")
+			}
 		}
 	}
 
+	st.setRelease(releaseIdOf(executable, customRelease))
+
 	result.cmd = exec.Command(executable,
 		"--webservice-disable-https=True",
 		"--log-file=/dev/stdout",
@@ -62,19 +80,27 @@ func newProcess(opts options) (result *process, err error) {
 		"SETTINGS_ENCRYPTION_KEY=" + opts.settingsEncryptionKey,
 	}
 
-	result.cmd.Stdout = os.Stdout
-	result.cmd.Stderr = os.Stderr
+	result.cmd.Stdout = io.MultiWriter(os.Stdout, st.logs)
+	result.cmd.Stderr = io.MultiWriter(os.Stderr, st.logs)
+	if err = ctx.Err(); err != nil {
+		return nil, fmt.Errorf("will not start process %q: %w", executable, err)
+	}
 	if err = result.cmd.Start(); err != nil {
-		return nil, fmt.Errorf("cannot start process %v: %w", result.cmd, err)
+		return nil, fmt.Errorf("cannot start process %q: %w", executable, err)
 	}
+	st.setRunning(result.cmd.Process.Pid)
 
 	return result, nil
 }
 
-func downloadCustomProcess(from string) (string, error) {
+func downloadCustomProcess(ctx context.Context, from string) (string, error) {
 	logger := log.With("customRelease", from)
 	logger.Info("downloading custom release, this could take a few minutes...")
-	rsp, err := http.Get(from)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, from, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot download custom release from URL %q: %w", from, err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("cannot download custom release from URL %q: %w", from, err)
 	}
@@ -104,23 +130,31 @@ func downloadCustomProcess(from string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("cannot place custom release %q: %w", from, err)
 	}
+	staging := target + ".new"
 
 	executableName := customReleaseExecutable()
-	executable, err := filepath.Abs(filepath.Join(target, executableName))
+	stagingExecutable, err := filepath.Abs(filepath.Join(staging, executableName))
 	if err != nil {
 		return "", fmt.Errorf("cannot use executable of custom release %q: %w", from, err)
 	}
 	executableFound := false
 
-	format, stream, err := archives.Identify(background, fBuf.Name(), fBuf)
+	installed := false
+	defer func() {
+		if !installed {
+			_ = os.RemoveAll(staging)
+		}
+	}()
+
+	format, stream, err := archives.Identify(ctx, fBuf.Name(), fBuf)
 	if err != nil {
 		return "", fmt.Errorf("cannot identifiy type of buffered (at %q) custom release %q: %w", fBuf.Name(), from, err)
 	}
 	if ex, ok := format.(archives.Extractor); ok {
-		if err := os.RemoveAll(target); err != nil {
-			return "", fmt.Errorf("cannot prepare custom release target %q: %w", target, err)
+		if err := os.RemoveAll(staging); err != nil {
+			return "", fmt.Errorf("cannot prepare custom release staging %q: %w", staging, err)
 		}
-		if err := ex.Extract(background, stream, func(ctx context.Context, in archives.FileInfo) error {
+		if err := ex.Extract(ctx, stream, func(_ context.Context, in archives.FileInfo) error {
 			if in.IsDir() {
 				return nil
 			}
@@ -144,9 +178,9 @@ func downloadCustomProcess(from string) (string, error) {
 				return fmt.Errorf("does not comply with expected format")
 			}
 
-			targetFn := filepath.Join(target, fName)
+			targetFn := filepath.Join(staging, fName)
 			_ = os.MkdirAll(filepath.Dir(targetFn), 0755)
-			if targetFn == executable {
+			if targetFn == stagingExecutable {
 				executableFound = true
 			}
 
@@ -178,8 +212,69 @@ func downloadCustomProcess(from string) (string, error) {
 		return "", fmt.Errorf("custom release %q does not contain %q", from, executableName)
 	}
 
-	logger.Info("custom release downloaded and extracted")
+	fixups, err := releaseFixupsToApply()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve fixups for custom release %q: %w", from, err)
+	}
+	if err := fixups.apply(filepath.Dir(processExecutable()), staging, logger); err != nil {
+		return "", fmt.Errorf("cannot fix custom release %q: %w", from, err)
+	}
+
+	logger.Info("validating custom release...")
+	if err := validateRelease(ctx, stagingExecutable); err != nil {
+		return "", fmt.Errorf("custom release %q failed validation: %w", from, err)
+	}
+
+	if err := swapCustomRelease(staging, target); err != nil {
+		return "", fmt.Errorf("cannot install custom release %q: %w", from, err)
+	}
+	installed = true
+
+	logger.Info("custom release downloaded, extracted and validated")
+
+	return filepath.Join(target, executableName), nil
+}
+
+// releaseIdOf identifies the release of the given executable, which changes
+// as soon as it is replaced by another one.
+func releaseIdOf(executable, customRelease string) string {
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%s", executable, customRelease)
+	if fi, err := os.Stat(executable); err == nil {
+		_, _ = fmt.Fprintf(h, "\x00%d\x00%d", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func swapCustomRelease(staging, target string) error {
+	old := target + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return fmt.Errorf("cannot cleanup %q: %w", old, err)
+	}
+	if _, err := os.Stat(target); err == nil {
+		if err := os.Rename(target, old); err != nil {
+			return fmt.Errorf("cannot move previous release %q out of the way: %w", target, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("cannot stat previous release %q: %w", target, err)
+	}
+	if err := os.Rename(staging, target); err != nil {
+		_ = os.Rename(old, target)
+		return fmt.Errorf("cannot move %q to %q: %w", staging, target, err)
+	}
+	_ = os.RemoveAll(old)
+	return nil
+}
 
+func previousCustomProcess(ctx context.Context) (string, error) {
+	target, err := filepath.Abs(customReleaseTarget())
+	if err != nil {
+		return "", err
+	}
+	executable := filepath.Join(target, customReleaseExecutable())
+	if err := validateRelease(ctx, executable); err != nil {
+		return "", err
+	}
 	return executable, nil
 }
 
@@ -200,35 +295,32 @@ func customReleaseExecutable() string {
 type process struct {
 	logger log.Logger
 	cmd    *exec.Cmd
+	state  *state
 }
 
 func (p *process) signal(sig os.Signal) {
 	cmd := p.cmd
-	if cmd == nil {
+	if cmd == nil || cmd.Process == nil {
 		return
 	}
-	ps := cmd.ProcessState
-	if ps == nil {
+	// ProcessState is only present after the process was waited for.
+	if cmd.ProcessState != nil {
 		return
 	}
-	if ps.Exited() {
-		return
-	}
-	proc := cmd.Process
-	if proc == nil {
-		return
-	}
-	if err := cmd.Process.Signal(sig); err != nil {
-		p.logger.Warnf("cannot send signal to process %v (#%d): %v", cmd, ps.Pid(), err)
+	if err := cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		p.logger.Warnf("cannot send signal to process %v (#%d): %v", cmd, cmd.Process.Pid, err)
 	}
 }
 
-func (p *process) wait() (int, error) {
+func (p *process) wait() (exitCode int, err error) {
 	cmd := p.cmd
 	if cmd == nil {
 		return 0, nil
 	}
-	err := cmd.Wait()
+	defer func() {
+		p.state.setExited(exitCode, err)
+	}()
+	err = cmd.Wait()
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/echocat/slf4g"
+)
+
+const (
+	releaseFixupsFileEnvVar = "RELEASE_FIXUPS_FILE"
+)
+
+type releaseFixupKind string
+
+const (
+	releaseFixupKindCopyBundled releaseFixupKind = "copyBundled"
+	releaseFixupKindChmod       releaseFixupKind = "chmod"
+	releaseFixupKindRemove      releaseFixupKind = "remove"
+)
+
+func (k *releaseFixupKind) UnmarshalText(text []byte) error {
+	switch v := releaseFixupKind(strings.TrimSpace(string(text))); v {
+	case releaseFixupKindCopyBundled, releaseFixupKindChmod, releaseFixupKindRemove:
+		*k = v
+		return nil
+	default:
+		return fmt.Errorf("unknown release fixup kind: %q", string(text))
+	}
+}
+
+type releaseFixupMode os.FileMode
+
+func (m *releaseFixupMode) UnmarshalText(text []byte) error {
+	v, err := strconv.ParseUint(strings.TrimSpace(string(text)), 8, 32)
+	if err != nil {
+		return fmt.Errorf("illegal file mode %q: %w", string(text), err)
+	}
+	*m = releaseFixupMode(v) & releaseFixupMode(os.ModePerm)
+	return nil
+}
+
+func (m releaseFixupMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m releaseFixupMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+type releaseFixup struct {
+	Kind releaseFixupKind `json:"kind"`
+	Path string           `json:"path"`
+	Mode releaseFixupMode `json:"mode,omitempty"`
+}
+
+func (f releaseFixup) apply(bundled, target string, logger log.Logger) error {
+	if !filepath.IsLocal(f.Path) {
+		return fmt.Errorf("path %q of %s fixup is not local to the release", f.Path, f.Kind)
+	}
+	targetFn := filepath.Join(target, f.Path)
+	logger = logger.With("fixup", f.Kind).With("file", targetFn)
+
+	switch f.Kind {
+	case releaseFixupKindCopyBundled:
+		if _, err := os.Stat(targetFn); err == nil {
+			return nil
+		} else if !os.IsNotExist(err) {
+			return fmt.Errorf("cannot stat %q: %w", targetFn, err)
+		}
+		sourceFn := filepath.Join(bundled, f.Path)
+		if _, err := os.Stat(sourceFn); os.IsNotExist(err) {
+			// The release may still work without it; if not, it will fail
+			// its validation afterward - with this as a hint why.
+			logger.With("source", sourceFn).Warn("release fixup skipped: bundled file to copy does not exist")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot stat %q: %w", sourceFn, err)
+		}
+		if err := copyFile(sourceFn, targetFn); err != nil {
+			return err
+		}
+		logger.With("source", sourceFn).Info("release fixup applied: copied bundled file")
+	case releaseFixupKindChmod:
+		fi, err := os.Stat(targetFn)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot stat %q: %w", targetFn, err)
+		}
+		if fi.Mode().Perm() == os.FileMode(f.Mode) {
+			return nil
+		}
+		if err := os.Chmod(targetFn, os.FileMode(f.Mode)); err != nil {
+			return fmt.Errorf("cannot change mode of %q to %v: %w", targetFn, f.Mode, err)
+		}
+		logger.With("mode", f.Mode).Info("release fixup applied: changed file mode")
+	case releaseFixupKindRemove:
+		if _, err := os.Lstat(targetFn); os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.RemoveAll(targetFn); err != nil {
+			return fmt.Errorf("cannot remove %q: %w", targetFn, err)
+		}
+		logger.Info("release fixup applied: removed file")
+	default:
+		return fmt.Errorf("unknown release fixup kind: %q", f.Kind)
+	}
+	return nil
+}
+
+type releaseFixups []releaseFixup
+
+func (fs releaseFixups) apply(bundled, target string, logger log.Logger) error {
+	for _, f := range fs {
+		if err := f.apply(bundled, target, logger); err != nil {
+			return fmt.Errorf("cannot apply release fixup %s of %q: %w", f.Kind, f.Path, err)
+		}
+	}
+	return nil
+}
+
+func (fs *releaseFixups) readFromFile(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return fmt.Errorf("could not open release fixups file %q: %w", fn, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	dec := json.NewDecoder(f)
+	if err := dec.Decode(fs); err != nil {
+		return fmt.Errorf("could not decode release fixups file %q: %w", fn, err)
+	}
+	return nil
+}
+
+func releaseFixupsToApply() (releaseFixups, error) {
+	if v := os.Getenv(releaseFixupsFileEnvVar); v != "" {
+		var result releaseFixups
+		if err := result.readFromFile(v); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	return releaseFixupsDefault(), nil
+}
+
+func releaseFixupsDefault() releaseFixups {
+	// Keep in sync with the "Fix Duplicati dependencies" step of the Dockerfile.
+	return releaseFixups{{
+		Kind: releaseFixupKindCopyBundled,
+		Path: "System.CommandLine.dll",
+	}, {
+		Kind: releaseFixupKindChmod,
+		Path: customReleaseExecutable(),
+		Mode: 0755,
+	}}
+}
+
+func copyFile(from, to string) error {
+	fIn, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", from, err)
+	}
+	defer func() {
+		_ = fIn.Close()
+	}()
+	fInStat, err := fIn.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat %q: %w", from, err)
+	}
+	_ = os.MkdirAll(filepath.Dir(to), 0755)
+	fOut, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fInStat.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("cannot create %q: %w", to, err)
+	}
+	if _, err := io.Copy(fOut, fIn); err != nil {
+		_ = fOut.Close()
+		return fmt.Errorf("cannot copy %q to %q: %w", from, to, err)
+	}
+	if err := fOut.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", to, err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+// withTestFixupTrees provides a bundled release and a staging tree of a custom
+// release, both with the given files.
+func withTestFixupTrees(t *testing.T, bundledFiles, stagingFiles map[string]string) (bundled, staging string) {
+	t.Helper()
+	dir := t.TempDir()
+	bundled, staging = filepath.Join(dir, "bundled"), filepath.Join(dir, "staging")
+	for base, files := range map[string]map[string]string{bundled: bundledFiles, staging: stagingFiles} {
+		if err := os.MkdirAll(base, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for fn, content := range files {
+			fn = filepath.Join(base, fn)
+			if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return bundled, staging
+}
+
+func Test_releaseFixupsToApply_default(t *testing.T) {
+	t.Setenv(releaseFixupsFileEnvVar, "")
+	t.Setenv(customReleaseExecutableEnvVar, "")
+
+	actual, err := releaseFixupsToApply()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := releaseFixups{
+		{Kind: releaseFixupKindCopyBundled, Path: "System.CommandLine.dll"},
+		{Kind: releaseFixupKindChmod, Path: customReleaseExecutableDefault, Mode: 0755},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v; but got: %v", expected, actual)
+	}
+}
+
+func Test_releaseFixupsToApply_defaultWithCustomExecutable(t *testing.T) {
+	t.Setenv(releaseFixupsFileEnvVar, "")
+	t.Setenv(customReleaseExecutableEnvVar, "bin/duplicati")
+
+	actual, err := releaseFixupsToApply()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(actual) != 2 || actual[1].Path != "bin/duplicati" {
+		t.Errorf("expected chmod of the custom executable; but got: %v", actual)
+	}
+}
+
+func Test_releaseFixupsToApply_file(t *testing.T) {
+	cases := []struct {
+		name          string
+		content       string
+		expected      releaseFixups
+		expectedError string
+	}{{
+		name: "all kinds",
+		content: `[
+			{"kind": "copyBundled", "path": "lib/a.dll"},
+			{"kind": " chmod ", "path": "duplicati-server", "mode": "0750"},
+			{"kind": "remove", "path": "b.dll"}
+		]`,
+		expected: releaseFixups{
+			{Kind: releaseFixupKindCopyBundled, Path: "lib/a.dll"},
+			{Kind: releaseFixupKindChmod, Path: "duplicati-server", Mode: 0750},
+			{Kind: releaseFixupKindRemove, Path: "b.dll"},
+		},
+	}, {
+		name:     "empty",
+		content:  `[]`,
+		expected: releaseFixups{},
+	}, {
+		name:     "mode without special bits",
+		content:  `[{"kind": "chmod", "path": "a", "mode": "4755"}]`,
+		expected: releaseFixups{{Kind: releaseFixupKindChmod, Path: "a", Mode: 0755}},
+	}, {
+		name:          "unknown kind",
+		content:       `[{"kind": "move", "path": "a"}]`,
+		expectedError: `unknown release fixup kind: "move"`,
+	}, {
+		name:          "illegal mode",
+		content:       `[{"kind": "chmod", "path": "a", "mode": "0999"}]`,
+		expectedError: `illegal file mode "0999"`,
+	}, {
+		name:          "illegal json",
+		content:       `{`,
+		expectedError: `could not decode release fixups file`,
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "fixups.json")
+			if err := os.WriteFile(fn, []byte(c.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(releaseFixupsFileEnvVar, fn)
+
+			actual, err := releaseFixupsToApply()
+			if c.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+					t.Errorf("expected error containing %q; but got: %v", c.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %v; but got: %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_releaseFixupsToApply_missingFile(t *testing.T) {
+	t.Setenv(releaseFixupsFileEnvVar, filepath.Join(t.TempDir(), "missing.json"))
+
+	if _, err := releaseFixupsToApply(); err == nil || !strings.Contains(err.Error(), "could not open release fixups file") {
+		t.Errorf("expected open error; but got: %v", err)
+	}
+}
+
+func Test_releaseFixup_apply_copyBundled(t *testing.T) {
+	bundled, staging := withTestFixupTrees(t, map[string]string{
+		"System.CommandLine.dll": "bundled",
+		"lib/a.dll":              "bundled a",
+	}, map[string]string{
+		"present.dll": "staged",
+	})
+	if err := os.WriteFile(filepath.Join(bundled, "present.dll"), []byte("bundled"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"System.CommandLine.dll", "bundled"},
+		{"lib/a.dll", "bundled a"},
+		// Files of the release itself are never replaced.
+		{"present.dll", "staged"},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			f := releaseFixup{Kind: releaseFixupKindCopyBundled, Path: c.path}
+			if err := f.apply(bundled, staging, log.GetLogger("test")); err != nil {
+				t.Fatal(err)
+			}
+			actual, err := os.ReadFile(filepath.Join(staging, c.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, string(actual))
+			}
+		})
+	}
+}
+
+func Test_releaseFixup_apply_copyBundledMissingSource(t *testing.T) {
+	output := withTestLogOutput(t)
+	bundled, staging := withTestFixupTrees(t, nil, nil)
+
+	f := releaseFixup{Kind: releaseFixupKindCopyBundled, Path: "System.CommandLine.dll"}
+	if err := f.apply(bundled, staging, log.GetLogger("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(staging, "System.CommandLine.dll")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be copied; but got: %v", err)
+	}
+	if actual := output.String(); !strings.Contains(actual, "bundled file to copy does not exist") {
+		t.Errorf("expected a warning about the missing bundled file; but got: %s", actual)
+	}
+}
+
+func Test_releaseFixup_apply_chmod(t *testing.T) {
+	bundled, staging := withTestFixupTrees(t, nil, map[string]string{
+		"duplicati-server": "#!/bin/sh\n",
+	})
+	fn := filepath.Join(staging, "duplicati-server")
+
+	f := releaseFixup{Kind: releaseFixupKindChmod, Path: "duplicati-server", Mode: 0755}
+	if err := f.apply(bundled, staging, log.GetLogger("test")); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fi.Mode().Perm(); actual != 0755 {
+		t.Errorf("expected mode 0755; but got: %v", actual)
+	}
+
+	// Files missing in the release are skipped.
+	f.Path = "missing"
+	if err := f.apply(bundled, staging, log.GetLogger("test")); err != nil {
+		t.Errorf("expected missing file to be skipped; but got: %v", err)
+	}
+}
+
+func Test_releaseFixup_apply_remove(t *testing.T) {
+	bundled, staging := withTestFixupTrees(t, nil, map[string]string{
+		"a.dll":       "a",
+		"sub/b.dll":   "b",
+		"sub/c/d.dll": "d",
+		"keep.dll":    "keep",
+	})
+
+	for _, path := range []string{"a.dll", "sub", "missing"} {
+		f := releaseFixup{Kind: releaseFixupKindRemove, Path: path}
+		if err := f.apply(bundled, staging, log.GetLogger("test")); err != nil {
+			t.Fatalf("cannot remove %q: %v", path, err)
+		}
+		if _, err := os.Lstat(filepath.Join(staging, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed; but got: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, "keep.dll")); err != nil {
+		t.Errorf("expected other files to be kept; but got: %v", err)
+	}
+}
+
+func Test_releaseFixup_apply_nonLocalPath(t *testing.T) {
+	bundled, staging := withTestFixupTrees(t, nil, nil)
+	outside := filepath.Join(filepath.Dir(staging), "outside")
+	if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"../outside", outside, ""} {
+		for _, kind := range []releaseFixupKind{releaseFixupKindCopyBundled, releaseFixupKindChmod, releaseFixupKindRemove} {
+			f := releaseFixup{Kind: kind, Path: path, Mode: 0777}
+			if err := f.apply(bundled, staging, log.GetLogger("test")); err == nil {
+				t.Errorf("expected %s of %q to be rejected", kind, path)
+			}
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("expected file outside of the release to be untouched; but got: %v", err)
+	}
+}
+
+func Test_releaseFixups_apply(t *testing.T) {
+	bundled, staging := withTestFixupTrees(t, map[string]string{
+		"System.CommandLine.dll": "bundled",
+	}, map[string]string{
+		"duplicati-server": "#!/bin/sh\n",
+		"obsolete.dll":     "obsolete",
+	})
+
+	fs := releaseFixups{
+		{Kind: releaseFixupKindCopyBundled, Path: "System.CommandLine.dll"},
+		{Kind: releaseFixupKindChmod, Path: "duplicati-server", Mode: 0755},
+		{Kind: releaseFixupKindRemove, Path: "obsolete.dll"},
+	}
+	if err := fs.apply(bundled, staging, log.GetLogger("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(staging, "System.CommandLine.dll")); err != nil {
+		t.Errorf("expected bundled file to be copied; but got: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(staging, "duplicati-server")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("expected executable to be made executable; but got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(staging, "obsolete.dll")); !os.IsNotExist(err) {
+		t.Errorf("expected obsolete file to be removed; but got: %v", err)
+	}
+
+	// The failing fixup is named.
+	fs = releaseFixups{{Kind: releaseFixupKindRemove, Path: "../x"}}
+	if err := fs.apply(bundled, staging, log.GetLogger("test")); err == nil || !strings.Contains(err.Error(), `remove of "../x"`) {
+		t.Errorf("expected error naming the fixup; but got: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// withTestExecutable provides an executable which touches marker once it was
+// started and then runs until it gets terminated.
+func withTestExecutable(t *testing.T) (marker string) {
+	t.Helper()
+	dir := t.TempDir()
+	marker = filepath.Join(dir, "started")
+	executable := filepath.Join(dir, "duplicati-server")
+	if err := os.WriteFile(executable, []byte("#!/bin/sh\ntouch '"+marker+"'\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(processExecutableEnvVar, executable)
+	return marker
+}
+
+func Test_process_signal(t *testing.T) {
+	withTestExecutable(t)
+	proc, err := newProcess(context.Background(), options{}, newState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proc.signal(syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = proc.wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		_ = proc.cmd.Process.Kill()
+		t.Fatalf("expected process to be terminated by the signal")
+	}
+
+	// Signals after the process exited are ignored.
+	proc.signal(syscall.SIGTERM)
+}
+
+func Test_newProcess_canceled(t *testing.T) {
+	marker := withTestExecutable(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	proc, err := newProcess(ctx, options{}, newState())
+	if err == nil {
+		_ = proc.cmd.Process.Kill()
+		t.Fatalf("expected process not to be started")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("expected process not to be started; but it was")
+	}
+}
+
+func Test_newProcess_canceledWhileDownloading(t *testing.T) {
+	marker := withTestExecutable(t)
+	t.Setenv(customReleaseTargetEnvVar, filepath.Join(t.TempDir(), "custom"))
+	requested := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+
+	done := make(chan error)
+	go func() {
+		proc, err := newProcess(ctx, options{customRelease: upstream.URL + "/release.zip"}, newState())
+		if err == nil {
+			_ = proc.cmd.Process.Kill()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("expected process not to be started")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected download to be canceled")
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("expected process not to be started; but it was")
+	}
+}
+
+func Test_newProcess_fallsBackToBundledRelease(t *testing.T) {
+	marker := withTestExecutable(t)
+	target := filepath.Join(t.TempDir(), "custom")
+	t.Setenv(customReleaseTargetEnvVar, target)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"duplicati-2/README", "unexpected/duplicati-server"} {
+		if _, err := zw.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	proc, err := newProcess(context.Background(), options{customRelease: upstream.URL + "/release.zip"}, newState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		proc.signal(syscall.SIGTERM)
+		_, _ = proc.wait()
+	}()
+
+	if err := awaitFile(marker); err != nil {
+		t.Errorf("expected bundled release to be started; but got: %v", err)
+	}
+	if _, err := os.Stat(target + ".new"); !os.IsNotExist(err) {
+		t.Errorf("expected staging of custom release to be removed; but got: %v", err)
+	}
+}
+
+func awaitFile(fn string) (err error) {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Stat(fn); err == nil {
+			return nil
+		}
+	}
+	return err
+}
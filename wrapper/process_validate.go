@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	releaseProbeTimeoutDefault = 60 * time.Second
+	releaseProbeTimeoutEnvVar  = "RELEASE_PROBE_TIMEOUT"
+	releaseProbeOutputLimit    = 2048
+	releaseProbeWaitDelay      = 2 * time.Second
+)
+
+func validateRelease(ctx context.Context, executable string) error {
+	if err := validateReleaseElf(executable); err != nil {
+		return err
+	}
+	if err := ensureReleaseExecutable(executable); err != nil {
+		return err
+	}
+	if err := probeRelease(ctx, executable); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateReleaseElf(executable string) error {
+	f, err := elf.Open(executable)
+	if err != nil {
+		return fmt.Errorf("executable %q is not a valid ELF binary: %w", executable, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	expectedMachine, expectedClass, ok := elfTargetOf(runtime.GOARCH)
+	if !ok {
+		// We do not know what to expect, so the probe has to decide.
+		return nil
+	}
+	if f.Machine != expectedMachine || f.Class != expectedClass {
+		return fmt.Errorf("executable %q was built for %v (%v) but this system requires %v (%v) for %s", executable, f.Machine, f.Class, expectedMachine, expectedClass, runtime.GOARCH)
+	}
+	return nil
+}
+
+func elfTargetOf(goarch string) (elf.Machine, elf.Class, bool) {
+	switch goarch {
+	case "amd64":
+		return elf.EM_X86_64, elf.ELFCLASS64, true
+	case "arm64":
+		return elf.EM_AARCH64, elf.ELFCLASS64, true
+	case "arm":
+		return elf.EM_ARM, elf.ELFCLASS32, true
+	case "386":
+		return elf.EM_386, elf.ELFCLASS32, true
+	default:
+		return 0, 0, false
+	}
+}
+
+func ensureReleaseExecutable(executable string) error {
+	fi, err := os.Stat(executable)
+	if err != nil {
+		return fmt.Errorf("cannot stat executable %q: %w", executable, err)
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("executable %q is a directory", executable)
+	}
+	if fi.Mode().Perm()&0111 == 0111 {
+		return nil
+	}
+	if err := os.Chmod(executable, fi.Mode().Perm()|0111); err != nil {
+		return fmt.Errorf("cannot make %q executable: %w", executable, err)
+	}
+	return nil
+}
+
+func probeRelease(ctx context.Context, executable string) error {
+	timeout := releaseProbeTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, "--help")
+	cmd.Env = []string{
+		"PATH=" + filepath.Dir(executable) + ":" + os.Getenv("PATH"),
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Children of the executable may outlive it and keep its output open.
+	cmd.WaitDelay = releaseProbeWaitDelay
+
+	err := cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("executable %q did not answer to --help within %v", executable, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("executable %q failed to answer to --help: %w; output: %s", executable, err, tailOf(out.String(), releaseProbeOutputLimit))
+	}
+	return nil
+}
+
+func releaseProbeTimeout() time.Duration {
+	if v := os.Getenv(releaseProbeTimeoutEnvVar); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return releaseProbeTimeoutDefault
+}
+
+func tailOf(in string, limit int) string {
+	in = strings.TrimSpace(in)
+	if len(in) <= limit {
+		return in
+	}
+	return "..." + in[len(in)-limit:]
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestElf provides a file with nothing but an ELF header of the given
+// machine and class - which is all validateReleaseElf looks at.
+func withTestElf(t *testing.T, machine elf.Machine, class elf.Class) string {
+	t.Helper()
+	var buf bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0x7f, 'E', 'L', 'F', byte(class), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT)}
+	var hdr any
+	switch class {
+	case elf.ELFCLASS64:
+		hdr = elf.Header64{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT), Ehsize: 64}
+	case elf.ELFCLASS32:
+		hdr = elf.Header32{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(machine), Version: uint32(elf.EV_CURRENT), Ehsize: 52}
+	default:
+		t.Fatalf("unsupported class: %v", class)
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), "duplicati-server")
+	if err := os.WriteFile(fn, buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// withTestProbeExecutable provides an executable script with the given body.
+func withTestProbeExecutable(t *testing.T, body string) string {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "duplicati-server")
+	if err := os.WriteFile(fn, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func Test_validateReleaseElf(t *testing.T) {
+	machine, class, ok := elfTargetOf(runtime.GOARCH)
+	if !ok {
+		t.Skipf("no ELF target known for %s", runtime.GOARCH)
+	}
+	otherMachine := elf.EM_AARCH64
+	if machine == otherMachine {
+		otherMachine = elf.EM_X86_64
+	}
+	otherClass := elf.ELFCLASS32
+	if class == otherClass {
+		otherClass = elf.ELFCLASS64
+	}
+
+	cases := []struct {
+		name          string
+		machine       elf.Machine
+		class         elf.Class
+		expectedError string
+	}{
+		{"matching", machine, class, ""},
+		{"otherMachine", otherMachine, class, "was built for " + otherMachine.String()},
+		{"otherClass", machine, otherClass, "(" + otherClass.String() + ")"},
+		{"otherMachineAndClass", otherMachine, otherClass, "but this system requires " + machine.String()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateReleaseElf(withTestElf(t, c.machine, c.class))
+			if c.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error; but got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+				t.Errorf("expected error containing %q; but got: %v", c.expectedError, err)
+			}
+		})
+	}
+}
+
+func Test_validateReleaseElf_notElf(t *testing.T) {
+	for name, content := range map[string]string{
+		"script": "#!/bin/sh\necho hello\n",
+		"empty":  "",
+		"html":   "<html><body>Not Found</body></html>",
+	} {
+		t.Run(name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "duplicati-server")
+			if err := os.WriteFile(fn, []byte(content), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := validateReleaseElf(fn); err == nil || !strings.Contains(err.Error(), "is not a valid ELF binary") {
+				t.Errorf("expected ELF error; but got: %v", err)
+			}
+		})
+	}
+}
+
+func Test_validateRelease_notElfIsNotProbed(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "probed")
+	fn := withTestProbeExecutable(t, "touch '"+marker+"'")
+
+	if err := validateRelease(context.Background(), fn); err == nil {
+		t.Errorf("expected error; but got none")
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("expected executable not to be probed; but got: %v", err)
+	}
+}
+
+func Test_ensureReleaseExecutable(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "duplicati-server")
+	if err := os.WriteFile(fn, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ensureReleaseExecutable(fn); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := fi.Mode().Perm(); actual != 0751 {
+		t.Errorf("expected mode 0751; but got: %v", actual)
+	}
+
+	if err := ensureReleaseExecutable(filepath.Dir(fn)); err == nil || !strings.Contains(err.Error(), "is a directory") {
+		t.Errorf("expected directory error; but got: %v", err)
+	}
+}
+
+func Test_probeRelease(t *testing.T) {
+	t.Setenv(releaseProbeTimeoutEnvVar, "500ms")
+
+	cases := []struct {
+		name          string
+		body          string
+		expectedError string
+	}{
+		{"answering", "echo 'Usage: duplicati-server [options]'", ""},
+		{"failing", "echo 'libicu not found' >&2\nexit 134", "failed to answer to --help: exit status 134; output: libicu not found"},
+		{"hanging", "exec sleep 60", "did not answer to --help within 500ms"},
+		// The child keeps the output open after the executable was killed.
+		{"hangingChild", "sleep 60 &\nwait", "did not answer to --help within 500ms"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := withTestProbeExecutable(t, c.body)
+
+			start := time.Now()
+			err := probeRelease(context.Background(), fn)
+			if c.expectedError == "" {
+				if err != nil {
+					t.Errorf("expected no error; but got: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), c.expectedError) {
+				t.Errorf("expected error containing %q; but got: %v", c.expectedError, err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond+releaseProbeWaitDelay+5*time.Second {
+				t.Errorf("expected probe to give up in time; but it took: %v", elapsed)
+			}
+		})
+	}
+}
+
+func Test_probeRelease_limitsOutput(t *testing.T) {
+	fn := withTestProbeExecutable(t, "head -c 10000 /dev/zero | tr '\\0' x\necho end\nexit 1")
+
+	err := probeRelease(context.Background(), fn)
+	if err == nil {
+		t.Fatal("expected error; but got none")
+	}
+	if actual := err.Error(); !strings.HasSuffix(actual, "xend") || len(actual) > releaseProbeOutputLimit+len(fn)+200 {
+		t.Errorf("expected only the tail of the output; but got %d bytes: %s", len(actual), tailOf(actual, 100))
+	}
+}
+
+func Test_releaseProbeTimeout(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", releaseProbeTimeoutDefault},
+		{"250ms", 250 * time.Millisecond},
+		{"2m", 2 * time.Minute},
+		{"0s", releaseProbeTimeoutDefault},
+		{"-1s", releaseProbeTimeoutDefault},
+		{"soon", releaseProbeTimeoutDefault},
+	}
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			t.Setenv(releaseProbeTimeoutEnvVar, c.value)
+			if actual := releaseProbeTimeout(); actual != c.expected {
+				t.Errorf("expected %v; but got: %v", c.expected, actual)
+			}
+		})
+	}
+}
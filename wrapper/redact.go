@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/echocat/slf4g"
+	"github.com/echocat/slf4g/fields"
+	"github.com/echocat/slf4g/level"
+	"github.com/echocat/slf4g/native/interceptor"
+)
+
+const (
+	redactedValue = "***"
+
+	// Secrets shorter than this are not masked, because these would mask
+	// random parts of unrelated values.
+	redactMinSecretLength = 6
+)
+
+var (
+	// logRedactor masks secrets in everything logged by the wrapper. It is
+	// registered as interceptor of the native logging provider by main.
+	logRedactor = &redactor{}
+
+	redactAuthorizationRegexp = regexp.MustCompile(`(?i)\b(Bearer|PreAuth|Basic)(\s+)[A-Za-z0-9._~+/=-]+`)
+	redactQueryRegexp         = regexp.MustCompile(`(?i)([?&;][A-Za-z0-9_.-]*(?:token|pass|secret|auth|key|credential)[A-Za-z0-9_.-]*=)[^&;#\s"']*`)
+	redactEnvRegexp           = regexp.MustCompile(`\b([A-Z0-9_]*(?:PASSWORD|TOKENS?|SECRET|KEY)=)[^\s\]"',]*`)
+	redactUserinfoRegexp      = regexp.MustCompile(`\b([A-Za-z][A-Za-z0-9+.-]*://)([^/?#\s@"']+)@`)
+)
+
+// redactor masks the values of known secrets, credentials of Authorization
+// headers, of URLs and token-like query parameters.
+type redactor struct {
+	mutex   sync.RWMutex
+	secrets []string
+}
+
+func (rd *redactor) setSecrets(payload secretsPayload) {
+	var secrets []string
+	for _, v := range []string{payload.WebservicePassword, payload.WebservicePreAuthTokens, payload.SettingsEncryptionKey} {
+		if len(v) >= redactMinSecretLength {
+			secrets = append(secrets, v)
+		}
+	}
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	rd.secrets = secrets
+}
+
+func (rd *redactor) redact(v string) string {
+	if v == "" {
+		return v
+	}
+	rd.mutex.RLock()
+	for _, secret := range rd.secrets {
+		v = strings.ReplaceAll(v, secret, redactedValue)
+	}
+	rd.mutex.RUnlock()
+	v = redactAuthorizationRegexp.ReplaceAllString(v, "${1}${2}"+redactedValue)
+	v = redactQueryRegexp.ReplaceAllString(v, "${1}"+redactedValue)
+	v = redactEnvRegexp.ReplaceAllString(v, "${1}"+redactedValue)
+	v = redactUserinfoRegexp.ReplaceAllStringFunc(v, redactUserinfo)
+	return v
+}
+
+// redactUserinfo masks the password of the userinfo of the given URL match.
+// Without a password, the user itself is likely a token and gets masked.
+func redactUserinfo(v string) string {
+	m := redactUserinfoRegexp.FindStringSubmatch(v)
+	if user, _, ok := strings.Cut(m[2], ":"); ok {
+		return m[1] + user + ":" + redactedValue + "@"
+	}
+	return m[1] + redactedValue + "@"
+}
+
+// redactValue returns the given value of a log field with all secrets
+// masked. If there is nothing to mask, it returns false.
+func (rd *redactor) redactValue(v any) (any, bool) {
+	switch tv := v.(type) {
+	case nil, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, uintptr,
+		float32, float64, time.Time, time.Duration, level.Level:
+		return nil, false
+	case string:
+		if redacted := rd.redact(tv); redacted != tv {
+			return redacted, true
+		}
+		return nil, false
+	case []byte:
+		return rd.redactValue(string(tv))
+	case fields.Lazy:
+		return rd.redactValue(tv.Get())
+	case fields.Filtered:
+		return nil, false
+	case error:
+		if msg := tv.Error(); rd.redact(msg) != msg {
+			return &redactedError{rd.redact(msg), tv}, true
+		}
+		return nil, false
+	default:
+		return rd.redactValue(fmt.Sprint(tv))
+	}
+}
+
+// OnBeforeLog implements interceptor.Interceptor.
+func (rd *redactor) OnBeforeLog(event log.Event, _ log.Provider) log.Event {
+	replacements := map[string]any{}
+	_ = event.ForEach(func(key string, value any) error {
+		if redacted, ok := rd.redactValue(value); ok {
+			replacements[key] = redacted
+		}
+		return nil
+	})
+	if len(replacements) == 0 {
+		return event
+	}
+	return event.WithAll(replacements)
+}
+
+// OnAfterLog implements interceptor.Interceptor.
+func (rd *redactor) OnAfterLog(log.Event, log.Provider) bool {
+	return true
+}
+
+// GetPriority implements interceptor.Interceptor. Secrets are masked before
+// any other interceptor sees the event.
+func (rd *redactor) GetPriority() int16 {
+	return -10000
+}
+
+var _ interceptor.Interceptor = logRedactor
+
+// redactedError keeps the original error available for errors.Is/As, but
+// reports a message without secrets.
+type redactedError struct {
+	message string
+	cause   error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.cause
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+func newRotatingFile(fn string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	result := &rotatingFile{
+		fn:         fn,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := result.open(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// rotatingFile is an append-only io.Writer which moves the file to fn.1
+// (fn.1 to fn.2, ...) as soon as it would exceed maxSize.
+type rotatingFile struct {
+	fn         string
+	maxSize    int64
+	maxBackups int
+
+	mutex sync.Mutex
+	f     *os.File
+	size  int64
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) open() error {
+	_ = os.MkdirAll(filepath.Dir(rf.fn), 0700)
+	f, err := os.OpenFile(rf.fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %w", rf.fn, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot stat %q: %w", rf.fn, err)
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return fmt.Errorf("cannot close %q: %w", rf.fn, err)
+	}
+	rf.f = nil
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(rf.backupName(i), rf.backupName(i+1))
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.fn, rf.backupName(1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rotate %q: %w", rf.fn, err)
+		}
+	} else if err := os.Remove(rf.fn); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot rotate %q: %w", rf.fn, err)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", rf.fn, i)
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -5,20 +5,23 @@ import (
 	"bytes"
 	"context"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	stdlog "log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/echocat/slf4g"
-	"github.com/echocat/slf4g/level"
-	sdk "github.com/echocat/slf4g/sdk/bridge"
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/js"
 )
@@ -28,51 +31,151 @@ const (
 	serverPort   = 8080
 )
 
-func newServer(opt options) (srv *server, err error) {
+var (
+	ingressUserHeaders = []string{"X-Remote-User-Id", "X-Remote-User-Name", "X-Remote-User-Display-Name"}
+)
+
+func newServer(opt options, st *state) (srv *server, err error) {
 	srv = &server{
 		options: opt,
+		state:   st,
 		logger:  log.GetLogger("server"),
 	}
 	srv.reverseProxy.Rewrite = srv.rewriteProxyRequest
 	srv.reverseProxy.ErrorHandler = srv.handleProxyError
-	srv.reverseProxy.ErrorLog = sdk.NewWrapper(srv.logger, level.Error)
 	srv.reverseProxy.ModifyResponse = srv.interceptResponse
 	srv.impl.Handler = http.HandlerFunc(srv.handleWrapper)
 	srv.impl.Addr = fmt.Sprintf(":%d", serverPort)
+	configureHttpServer(&srv.impl, opt)
+	srv.authLimiter = newRateLimiter(opt.authRateLimit)
+
+	if srv.prefixResolver, err = newPrefixResolver(opt); err != nil {
+		return nil, err
+	}
+
+	if srv.ingressSources, err = parseAddressPrefixes(opt.ingressSources); err != nil {
+		return nil, fmt.Errorf("illegal ingress_sources: %w", err)
+	}
+	if srv.trustedProxies, err = parseAddressPrefixes(opt.trustedProxies); err != nil {
+		return nil, fmt.Errorf("illegal trusted_proxies: %w", err)
+	}
+
+	for _, v := range opt.allowedHosts {
+		if v = strings.TrimSpace(v); v != "" {
+			srv.allowedHosts = append(srv.allowedHosts, hostnameOf(v))
+		}
+	}
 
 	if srv.upstreamUrl, err = url.Parse(fmt.Sprintf("http://localhost:%d", upstreamPort)); err != nil {
 		return nil, fmt.Errorf("cannot parse target url: %w", err)
 	}
+	srv.upstreamClient.Timeout = upstreamCheckTimeout
+	srv.upstreamClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
 
 	if srv.listener, err = net.Listen("tcp", srv.impl.Addr); err != nil {
 		return nil, fmt.Errorf("cannot listen to %s: %w", srv.impl.Addr, err)
 	}
+	srv.listener = limitListener(srv.listener, opt.httpMaxConnections)
+
+	srv.tokens = newAccessTokens(srv)
+	srv.assets = newAssetCache(srv)
+
+	if srv.guiPreferences, err = newGuiPreferences(srv.logger); err != nil {
+		return nil, err
+	}
+
+	if srv.audit, err = newAuditLog(opt); err != nil {
+		return nil, err
+	}
+
+	if srv.accessLog, err = newAccessLog(opt); err != nil {
+		return nil, err
+	}
+
+	// Requests of trusted proxies have to login like on the direct access
+	// port; so this is required even if the port itself is disabled.
+	if opt.directAccess || len(srv.trustedProxies) > 0 {
+		if srv.direct, err = newDirectServer(srv, opt.directAccess); err != nil {
+			return nil, err
+		}
+	}
 
 	return srv, nil
 }
 
 type server struct {
 	options      options
+	state        *state
 	logger       log.Logger
 	reverseProxy httputil.ReverseProxy
 	upstreamUrl  *url.URL
 
+	prefixResolver prefixResolver
+	ingressSources []netip.Prefix
+	trustedProxies []netip.Prefix
+	allowedHosts   []string
+
+	upstreamClient   http.Client
+	upstreamReady    atomic.Bool
+	upstreamWasReady atomic.Bool
+
+	authLimiter *rateLimiter
+
 	impl     http.Server
 	listener net.Listener
+
+	direct         *directServer
+	audit          *auditLog
+	accessLog      *accessLog
+	tokens         *accessTokens
+	assets         *assetCache
+	guiPreferences *guiPreferences
 }
 
 func (srv *server) serve() error {
-	srv.logger.
-		With("addr", srv.impl.Addr).
-		Info("wrapper listening...")
-	err := srv.impl.Serve(srv.listener)
-	if errors.Is(err, http.ErrServerClosed) {
-		return nil
+	errs := make(chan error, 2)
+	if srv.direct != nil && srv.direct.listener != nil {
+		go func() {
+			errs <- srv.direct.serve()
+		}()
 	}
-	return err
+	go func() {
+		srv.logger.
+			With("addr", srv.impl.Addr).
+			Info("wrapper listening...")
+		err := srv.impl.Serve(srv.listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		errs <- err
+	}()
+	return <-errs
 }
 
-func (srv *server) shutdown() error {
+func (srv *server) shutdown() (rErr error) {
+	if srv.accessLog != nil {
+		defer func() {
+			if err := srv.accessLog.Close(); err != nil && rErr == nil {
+				rErr = err
+			}
+		}()
+	}
+	if srv.audit != nil {
+		defer func() {
+			if err := srv.audit.Close(); err != nil && rErr == nil {
+				rErr = err
+			}
+		}()
+	}
+	if srv.direct != nil {
+		defer func() {
+			if err := srv.direct.shutdown(); err != nil && rErr == nil {
+				rErr = err
+			}
+		}()
+	}
 	return srv.impl.Shutdown(context.Background())
 }
 
@@ -81,10 +184,69 @@ func (srv *server) Close() error {
 }
 
 func (srv *server) handleWrapper(ow http.ResponseWriter, r *http.Request) {
-	rw := &httpResponseWriter{ow, http.StatusOK}
+	if !srv.isIngressSource(r) {
+		// Only the ingress gateway tells us who the user is; this is stripped
+		// before anything (like the access log) can see it.
+		stripUserHeaders(r)
+	}
+	srv.handleWrapperWith(ow, r, srv.handleIngress)
+}
+
+func (srv *server) handleIngress(rw http.ResponseWriter, r *http.Request) {
+	if !srv.isIngressSource(r) && srv.direct != nil && srv.isTrustedProxy(r) {
+		srv.direct.handle(rw, r)
+		return
+	}
+	if !isPublicWrapperPath(r.URL.Path) && !srv.isIngressSource(r) {
+		srv.loggerOf(r).With("uri", r.RequestURI).
+			With("method", r.Method).
+			With("remote", r.RemoteAddr).
+			Warn("rejected request from address which is not an allowed ingress source")
+		if wantsJson(r) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusForbidden)
+			_, _ = fmt.Fprint(rw, `{"Error":"Forbidden"}`)
+			return
+		}
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err := srv.checkRequestOrigin(r, false); err != nil {
+		srv.rejectCrossSite(rw, r, err)
+		return
+	}
+	srv.handle(rw, r)
+}
+
+func (srv *server) isIngressSource(r *http.Request) bool {
+	addr, ok := remoteAddrOf(r)
+	if !ok {
+		return false
+	}
+	return addr.IsLoopback() || containsAddr(srv.ingressSources, addr)
+}
+
+func (srv *server) isTrustedProxy(r *http.Request) bool {
+	addr, ok := remoteAddrOf(r)
+	if !ok {
+		return false
+	}
+	return containsAddr(srv.trustedProxies, addr)
+}
+
+func stripUserHeaders(r *http.Request) {
+	for _, header := range ingressUserHeaders {
+		r.Header.Del(header)
+	}
+}
+
+func (srv *server) handleWrapperWith(ow http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw := &httpResponseWriter{ResponseWriter: ow, status: http.StatusOK}
 	started := time.Now()
+	r = r.WithContext(withRequestMetrics(r.Context(), &requestMetrics{}))
 	defer func() {
-		srv.logger.With("uri", r.RequestURI).
+		srv.recordAccess(r, rw, started)
+		srv.loggerOf(r).With("uri", r.RequestURI).
 			With("method", r.Method).
 			With("remote", r.RemoteAddr).
 			With("duration", time.Now().Sub(started).Truncate(time.Millisecond)).
@@ -95,26 +257,113 @@ func (srv *server) handleWrapper(ow http.ResponseWriter, r *http.Request) {
 		http.Error(rw, "Bad Request", http.StatusBadRequest)
 		return
 	}
-	srv.handle(rw, r)
+	requestId := resolveRequestId(r)
+	r.Header.Set(requestIdHeader, requestId)
+	rw.Header().Set(requestIdHeader, requestId)
+	r = r.WithContext(withRequestId(r.Context(), requestId))
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		clearDeadlines(ow)
+	}
+	if !srv.checkConnectionLimit(rw, r) {
+		return
+	}
+	if !srv.checkRateLimit(rw, r) {
+		return
+	}
+	r = r.WithContext(withPrefix(r.Context(), srv.prefixResolver.resolve(r)))
+	if srv.options.compression {
+		if crw := newCompressingResponseWriter(rw, r); crw != nil {
+			defer func() {
+				if err := crw.Close(); err != nil {
+					srv.loggerOf(r).WithError(err).Debug("cannot finish compressed response")
+				}
+			}()
+			next(crw, r)
+			return
+		}
+	}
+	next(rw, r)
 }
 
 func (srv *server) handle(rw http.ResponseWriter, r *http.Request) {
+	if accessPathOf(r) == upstreamAuthRefreshPath {
+		// Also /API/v1/auth/refresh must never reach Duplicati, which would
+		// issue a real token to everyone.
+		srv.handlerAuthRefresh(rw, r)
+		return
+	}
 	switch r.URL.Path {
 	case "/", "", "/index.html":
 		srv.handlerIndex(rw, r)
-	case "/api/v1/auth/refresh":
-		srv.handlerAuthRefresh(rw, r)
+	case wrapperPathPrefix + "health":
+		srv.handlerHealth(rw, r)
+	case wrapperPathPrefix + "ready":
+		srv.handlerReady(rw, r)
+	case wrapperPathPrefix + "audit":
+		srv.handlerAudit(rw, r)
 	default:
-		srv.reverseProxy.ServeHTTP(rw, r)
+		srv.handleAudited(rw, r, srv.handleUpstream)
+	}
+}
+
+func (srv *server) handleUpstream(rw http.ResponseWriter, r *http.Request) {
+	if !srv.authorize(rw, r) {
+		return
 	}
+	if err := srv.tokens.checkBinding(r); err != nil {
+		srv.loggerOf(r).WithError(err).
+			With("uri", r.URL.Path).
+			With("remote", r.RemoteAddr).
+			Warn("rejected request with foreign access token")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprint(rw, `{"Error":"Access token belongs to another session"}`)
+		return
+	}
+	if isCacheableAsset(r) && srv.assets.serve(rw, r) {
+		return
+	}
+	srv.proxy(rw, r)
+}
+
+// proxy passes the request to the upstream. Errors the reverse proxy only
+// logs itself (like broken response bodies) are logged with the request ID,
+// like the ones handleProxyError logs.
+func (srv *server) proxy(rw http.ResponseWriter, r *http.Request) {
+	rp := srv.reverseProxy
+	rp.ErrorLog = stdlog.New(proxyErrorLog{srv.loggerOf(r)}, "", 0)
+	rp.ServeHTTP(rw, r)
+}
+
+// proxyErrorLog logs everything written to it as errors of logger. Other than
+// the writer of sdk.NewWrapper it keeps the fields of logger.
+type proxyErrorLog struct {
+	logger log.Logger
+}
+
+func (w proxyErrorLog) Write(p []byte) (int, error) {
+	w.logger.Error(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
 }
 
 func (srv *server) handlerIndex(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET", "HEAD":
-		ingressPath := r.Header.Get("X-Ingress-Path")
-		ingressPath = strings.TrimSuffix(ingressPath, "/")
-		rw.Header().Set("Location", ingressPath+srv.options.gui.initPath())
+		gui, err := srv.guiOf(rw, r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		route, err := deepLinkOf(gui, r.URL.Query())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !srv.isReady(r.Context()) {
+			srv.serveStartingPage(rw, r)
+			return
+		}
+		rw.Header().Set("Location", prefixOf(r)+gui.initPath()+route)
 		rw.WriteHeader(http.StatusTemporaryRedirect)
 	default:
 		http.Error(rw, "Bad Request", http.StatusMethodNotAllowed)
@@ -124,22 +373,62 @@ func (srv *server) handlerIndex(rw http.ResponseWriter, r *http.Request) {
 func (srv *server) handlerAuthRefresh(rw http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET", "POST":
-		_, _ = fmt.Fprintf(rw, `{"AccessToken":null}`)
+		var payload accessTokenPayload
+		scoped := !srv.roleOf(r).permits(roleAdmin)
+		if token, err := srv.tokens.get(r, scoped); err != nil {
+			// ngax works fine without token; therefore we do not fail here.
+			srv.loggerOf(r).WithError(err).Warn("cannot obtain access token; continue without it")
+		} else {
+			payload.AccessToken = &token
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(rw).Encode(payload)
 	default:
 		http.Error(rw, "Bad Request", http.StatusMethodNotAllowed)
 	}
 }
 
 func (srv *server) rewriteProxyRequest(pr *httputil.ProxyRequest) {
+	metricsOf(pr.In).startUpstream()
 	pr.SetURL(srv.upstreamUrl)
 	pr.SetXForwarded()
 	pr.Out.Host = pr.In.Host
 	pr.Out.Header.Set("Authorization", "PreAuth "+srv.options.webservicePreAuthTokens)
+	if q := pr.Out.URL.Query(); q.Get("token") != "" {
+		// Proxy-only tokens are only valid for us; the request was already
+		// authorized.
+		if upstream, ok := srv.tokens.upstreamTokenOf(q.Get("token")); ok && upstream != q.Get("token") {
+			q.Set("token", upstream)
+			pr.Out.URL.RawQuery = q.Encode()
+		}
+	}
+	if srv.options.compression || isBackupsListPath(pr.In) {
+		// We compress responses ourselves (after they were rewritten by
+		// interceptResponse); so there is no need to decode them first. The
+		// backup list has to be readable to redact it.
+		pr.Out.Header.Set("Accept-Encoding", "identity")
+	} else if v := pr.In.Header.Get("Accept-Encoding"); v != "" {
+		if v = filterAcceptEncoding(v); v != "" {
+			pr.Out.Header.Set("Accept-Encoding", v)
+		} else {
+			pr.Out.Header.Del("Accept-Encoding")
+		}
+	}
 }
 
-func (srv *server) handleProxyError(rw http.ResponseWriter, _ *http.Request, err error) {
-	srv.logger.WithError(err).Error()
-	http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+func (srv *server) handleProxyError(rw http.ResponseWriter, r *http.Request, err error) {
+	metricsOf(r).finishUpstream()
+	if errors.Is(err, context.Canceled) {
+		// The client went away (like closed tabs or websockets); this says
+		// nothing about the upstream.
+		srv.loggerOf(r).WithError(err).Debug("client canceled request")
+		return
+	}
+	srv.loggerOf(r).WithError(err).Error()
+	srv.state.recordError(err)
+	srv.setUpstreamReady(false)
+	srv.serveUnavailable(rw, r, err)
 }
 
 var (
@@ -156,43 +445,117 @@ var (
 	}(rewritePrefixJs)
 )
 
-func (srv *server) fixJsRequestsScript(ingressPath string) string {
-	return `<script>const __wrapperPrefix__="` + ingressPath + `";` + rewritePrefixJsCompressed + `</script>`
+// fixJsRequestsScriptContent does not contain the prefix itself to keep it
+// static, which allows to allow it via its hash in the CSP.
+var fixJsRequestsScriptContent = `const __wrapperPrefix__=document.currentScript.dataset.prefix;` + rewritePrefixJsCompressed
+
+func fixJsRequestsScript(prefix string) string {
+	return `<script data-prefix="` + html.EscapeString(prefix) + `">` + fixJsRequestsScriptContent + `</script>`
 }
 
 func (srv *server) interceptResponse(rsp *http.Response) error {
+	metricsOf(rsp.Request).finishUpstream()
+	srv.setUpstreamReady(true)
+	// We already answer with the correlation ID of the request ourselves.
+	rsp.Header.Del(requestIdHeader)
+	prefix := prefixOf(rsp.Request)
+	if prefix != "" {
+		rewriteResponseHeaders(rsp.Header, rsp.Request.Host, prefix)
+	}
+	if srv.options.securityHeaders {
+		srv.applySecurityHeaders(rsp.Header)
+	}
+
 	if rsp.Request.Method != http.MethodGet {
 		return nil
 	}
-	ingressPath := rsp.Request.Header.Get("X-Ingress-Path")
-	ingressPath = strings.TrimSuffix(ingressPath, "/")
-	if ingressPath == "" {
+	if rsp.StatusCode != http.StatusOK {
 		return nil
 	}
-	if !strings.HasPrefix(rsp.Header.Get("Content-Type"), "text/html") {
+	var rules []rewriteRule
+	if prefix != "" {
+		rules = rewriteRulesFor(rsp.Request.URL.Path, rsp.Header.Get("Content-Type"))
+	}
+	if gui := guiOfPath(rsp.Request.URL.Path); srv.options.guiSwitcher && gui != "" && isHtmlContentType(rsp.Header.Get("Content-Type")) {
+		rules = append(rules, rewriteRule{apply: func(b []byte, prefix string) []byte {
+			return injectGuiSwitcher(b, prefix, gui)
+		}})
+	}
+	rule, redact := srv.redactionRuleOf(rsp.Request)
+	if redact {
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
 		return nil
 	}
+	if ok, err := rewriteBody(rsp, prefix, rules); err != nil {
+		return err
+	} else if !ok && redact {
+		// Secrets which cannot be redacted must never be passed through.
+		srv.loggerOf(rsp.Request).With("uri", rsp.Request.URL.RequestURI()).
+			With("encoding", rsp.Header.Get("Content-Encoding")).
+			Error("cannot redact response with unsupported content encoding")
+		replaceResponse(rsp, http.StatusBadGateway, `{"Error":"Bad Gateway"}`)
+	} else if !ok {
+		srv.loggerOf(rsp.Request).With("uri", rsp.Request.URL.RequestURI()).
+			With("encoding", rsp.Header.Get("Content-Encoding")).
+			Warn("cannot rewrite response with unsupported content encoding")
+	}
+	return nil
+}
+
+// replaceResponse discards the body of the response and answers with the
+// given status and JSON body instead.
+func replaceResponse(rsp *http.Response, status int, body string) {
+	_ = rsp.Body.Close()
+	for _, header := range []string{"Content-Encoding", "ETag", "Last-Modified"} {
+		rsp.Header.Del(header)
+	}
+	rsp.Header.Set("Content-Type", "application/json")
+	rsp.Header.Set("Cache-Control", "no-store")
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rsp.StatusCode = status
+	rsp.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	rsp.ContentLength = int64(len(body))
+	rsp.Body = io.NopCloser(strings.NewReader(body))
+}
+
+// rewriteBody applies the given rules to the body of the response, which is
+// decoded (and encoded again afterward) if required. It returns false if the
+// body was left untouched because of an unsupported (or stacked) encoding.
+func rewriteBody(rsp *http.Response, prefix string, rules []rewriteRule) (bool, error) {
+	encoding, ok := contentEncodingOf(rsp.Header.Get("Content-Encoding"))
+	if !ok {
+		return false, nil
+	}
 
 	b, err := io.ReadAll(rsp.Body)
 	if err != nil {
-		return fmt.Errorf("cannot buffer HTML body: %w", err)
+		return false, fmt.Errorf("cannot buffer body: %w", err)
 	}
 	if err := rsp.Body.Close(); err != nil {
-		return fmt.Errorf("cannot close upstream response body: %w", err)
+		return false, fmt.Errorf("cannot close upstream response body: %w", err)
 	}
 
-	if bytes.Contains(b, []byte(`<base href="`)) {
-		b = bytes.Replace(b, []byte(`<base href="`), []byte(srv.fixJsRequestsScript(ingressPath)+`<base href="`+ingressPath), 1)
+	if b, err = encoding.decode(b); err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		b = rule.apply(b, prefix)
+	}
+	if b, err = encoding.encode(b); err != nil {
+		return false, err
 	}
 	rsp.Body = io.NopCloser(bytes.NewReader(b))
 	rsp.ContentLength = int64(len(b))
 	rsp.Header.Set("Content-Length", strconv.Itoa(len(b)))
-	return nil
+	return true, nil
 }
 
 type httpResponseWriter struct {
 	http.ResponseWriter
-	status int
+	status  int
+	written int64
 }
 
 func (hrw *httpResponseWriter) WriteHeader(statusCode int) {
@@ -200,6 +563,12 @@ func (hrw *httpResponseWriter) WriteHeader(statusCode int) {
 	hrw.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (hrw *httpResponseWriter) Write(b []byte) (int, error) {
+	n, err := hrw.ResponseWriter.Write(b)
+	hrw.written += int64(n)
+	return n, err
+}
+
 func (hrw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := hrw.ResponseWriter.(http.Hijacker)
 	if !ok {
@@ -207,3 +576,7 @@ func (hrw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	}
 	return h.Hijack()
 }
+
+func (hrw *httpResponseWriter) Unwrap() http.ResponseWriter {
+	return hrw.ResponseWriter
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	accessLogFileDefault = "/data/access.log"
+	accessLogFileEnvVar  = "ACCESS_LOG_FILE"
+	accessLogMaxSize     = 10 * 1024 * 1024
+	accessLogMaxBackups  = 5
+	accessLogTimeFormat  = "02/Jan/2006:15:04:05 -0700"
+)
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"requestId,omitempty"`
+	Remote    string    `json:"remote"`
+	UserId    string    `json:"userId,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Method    string    `json:"method"`
+	Uri       string    `json:"uri"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"durationMs"`
+	Upstream  *float64  `json:"upstreamMs,omitempty"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// requestMetrics are collected while a request is handled, to be reported by
+// the access log.
+type requestMetrics struct {
+	upstreamStarted time.Time
+	upstreamLatency time.Duration
+}
+
+type requestMetricsKey struct{}
+
+func withRequestMetrics(ctx context.Context, m *requestMetrics) context.Context {
+	return context.WithValue(ctx, requestMetricsKey{}, m)
+}
+
+// metricsOf never returns nil, to allow to record values unconditionally.
+func metricsOf(r *http.Request) *requestMetrics {
+	if r != nil {
+		if v, ok := r.Context().Value(requestMetricsKey{}).(*requestMetrics); ok {
+			return v
+		}
+	}
+	return &requestMetrics{}
+}
+
+func (m *requestMetrics) startUpstream() {
+	m.upstreamStarted = time.Now()
+}
+
+func (m *requestMetrics) finishUpstream() {
+	if !m.upstreamStarted.IsZero() {
+		m.upstreamLatency = time.Since(m.upstreamStarted)
+	}
+}
+
+func newAccessLog(opt options) (*accessLog, error) {
+	format := optionsAccessLogFormat(opt.accessLog.String())
+	if format == accessLogFormatNone {
+		return nil, nil
+	}
+	fn := accessLogFileDefault
+	if v := os.Getenv(accessLogFileEnvVar); v != "" {
+		fn = v
+	}
+	f, err := newRotatingFile(fn, accessLogMaxSize, accessLogMaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open access log: %w", err)
+	}
+	return &accessLog{format, f}, nil
+}
+
+type accessLog struct {
+	format optionsAccessLogFormat
+	file   *rotatingFile
+}
+
+func (srv *server) recordAccess(r *http.Request, rw *httpResponseWriter, started time.Time) {
+	al := srv.accessLog
+	if al == nil {
+		return
+	}
+	// User headers of anything else than the ingress or an authenticated
+	// direct session were already stripped by the handlers.
+	id, name := userOf(r)
+	entry := accessLogEntry{
+		Time:      started,
+		RequestId: requestIdOf(r),
+		Remote:    srv.clientAddrOf(r),
+		UserId:    id,
+		User:      name,
+		Method:    r.Method,
+		Uri:       logRedactor.redact(r.RequestURI),
+		Protocol:  r.Proto,
+		Status:    rw.status,
+		Bytes:     rw.written,
+		Duration:  float64(time.Since(started).Microseconds()) / 1000,
+		Referer:   logRedactor.redact(r.Referer()),
+		UserAgent: r.UserAgent(),
+	}
+	if m := metricsOf(r); !m.upstreamStarted.IsZero() {
+		v := float64(m.upstreamLatency.Microseconds()) / 1000
+		entry.Upstream = &v
+	}
+	if err := al.record(entry); err != nil {
+		srv.loggerOf(r).WithError(err).Warn("cannot write access log")
+	}
+}
+
+func (al *accessLog) record(entry accessLogEntry) error {
+	var buf bytes.Buffer
+	switch al.format {
+	case accessLogFormatJson:
+		if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+			return fmt.Errorf("cannot encode access log entry: %w", err)
+		}
+	default:
+		al.formatCommon(&buf, entry)
+	}
+	if _, err := al.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("cannot write access log entry: %w", err)
+	}
+	return nil
+}
+
+// formatCommon writes the entry in the Common (or Combined) Log Format. The
+// duration of the request and the latency of the upstream (both in seconds)
+// are appended as additional fields, like nginx's $request_time and
+// $upstream_response_time.
+func (al *accessLog) formatCommon(buf *bytes.Buffer, entry accessLogEntry) {
+	user := entry.User
+	if user == "" {
+		user = entry.UserId
+	}
+	bytesSent := "-"
+	if entry.Bytes > 0 {
+		bytesSent = strconv.FormatInt(entry.Bytes, 10)
+	}
+	upstream := "-"
+	if entry.Upstream != nil {
+		upstream = strconv.FormatFloat(*entry.Upstream/1000, 'f', 3, 64)
+	}
+
+	_, _ = fmt.Fprintf(buf, "%s - %s [%s] %s %d %s",
+		clfField(entry.Remote),
+		clfField(user),
+		entry.Time.Format(accessLogTimeFormat),
+		clfQuote(entry.Method+" "+entry.Uri+" "+entry.Protocol),
+		entry.Status,
+		bytesSent,
+	)
+	if al.format == accessLogFormatCombined {
+		_, _ = fmt.Fprintf(buf, " %s %s", clfQuote(entry.Referer), clfQuote(entry.UserAgent))
+	}
+	_, _ = fmt.Fprintf(buf, " %s %s\n", strconv.FormatFloat(entry.Duration/1000, 'f', 3, 64), upstream)
+}
+
+func clfField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+func clfQuote(v string) string {
+	if v == "" {
+		return `"-"`
+	}
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, r := range v {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < ' ' || r == 0x7f:
+			_, _ = fmt.Fprintf(&buf, "\\x%02x", r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// clientAddrOf returns the address of the client. Behind the ingress (or a
+// trusted proxy) this is taken from X-Forwarded-For, because the remote
+// address is the one of the proxy. Only the rightmost entry which is not one
+// of our proxies can be trusted; everything left of it was sent by the client
+// itself.
+func (srv *server) clientAddrOf(r *http.Request) string {
+	if srv.isIngressSource(r) || srv.isTrustedProxy(r) {
+		entries := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		result := ""
+		for i := len(entries) - 1; i >= 0; i-- {
+			v := strings.TrimSpace(entries[i])
+			if v == "" {
+				continue
+			}
+			result = v
+			if !srv.isProxyAddr(v) {
+				break
+			}
+		}
+		if result != "" {
+			return result
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// isProxyAddr reports whether the given address is one of the ingress
+// sources or trusted proxies.
+func (srv *server) isProxyAddr(v string) bool {
+	addr, err := netip.ParseAddr(v)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsLoopback() || containsAddr(srv.ingressSources, addr) || containsAddr(srv.trustedProxies, addr)
+}
+
+func (al *accessLog) Close() error {
+	return al.file.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func Test_server_clientAddrOf(t *testing.T) {
+	srv := &server{
+		ingressSources: []netip.Prefix{netip.MustParsePrefix("172.30.32.2/32")},
+		trustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/28")},
+	}
+	cases := []struct {
+		name     string
+		remote   string
+		xff      []string
+		expected string
+	}{
+		{"no header", "192.0.2.10", nil, "192.0.2.10"},
+		{"proxy", "192.0.2.10", []string{"203.0.113.5"}, "203.0.113.5"},
+		{"proxy with spoofed entries", "192.0.2.10", []string{"1.2.3.4, 5.6.7.8, 203.0.113.5"}, "203.0.113.5"},
+		{"proxy with spoofed header", "192.0.2.10", []string{"1.2.3.4", "203.0.113.5"}, "203.0.113.5"},
+		{"chained proxies", "192.0.2.10", []string{"1.2.3.4, 203.0.113.5, 192.0.2.11"}, "203.0.113.5"},
+		{"ingress", "172.30.32.2", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"ingress behind loopback", "172.30.32.2", []string{"198.51.100.7, 127.0.0.1"}, "198.51.100.7"},
+		{"only proxies", "192.0.2.10", []string{"192.0.2.12, 192.0.2.11"}, "192.0.2.12"},
+		{"other client", "198.51.100.99", []string{"1.2.3.4"}, "198.51.100.99"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			r.RemoteAddr = c.remote + ":12345"
+			for _, v := range c.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if actual := srv.clientAddrOf(r); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_server_rateLimitKeyOf_ignoresSpoofedForwardedFor(t *testing.T) {
+	srv := &server{
+		trustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.10/32")},
+	}
+	keys := map[string]bool{}
+	for _, spoofed := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		r := httptest.NewRequest(http.MethodPost, "http://localhost/_wrapper/login", nil)
+		r.RemoteAddr = "192.0.2.10:12345"
+		r.Header.Set("X-Forwarded-For", spoofed+", 203.0.113.5")
+		keys[srv.rateLimitKeyOf(r)] = true
+	}
+	if len(keys) != 1 || !keys["addr:203.0.113.5"] {
+		t.Errorf("expected only key %q; but got: %v", "addr:203.0.113.5", keys)
+	}
+}
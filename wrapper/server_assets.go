@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	assetCacheMaxSize      = 64 * 1024 * 1024
+	assetCacheMaxEntrySize = 8 * 1024 * 1024
+	assetFetchTimeout      = 30 * time.Second
+	// assetCacheMaxUncacheable limits the number of remembered assets which
+	// cannot be cached (like unknown ones), which could be requested
+	// endlessly.
+	assetCacheMaxUncacheable = 1024
+	// assetCacheMaxVariants limits the number of rewritten and compressed
+	// bodies kept per asset, because each prefix results in another one.
+	assetCacheMaxVariants = 8
+
+	// Assets with a content hash in their file name never change, because
+	// another content results in another name. All others have to be
+	// revalidated using their ETag; their URL stays the same across releases.
+	assetCacheControlImmutable  = "public, max-age=31536000, immutable"
+	assetCacheControlRevalidate = "no-cache"
+)
+
+var (
+	// Either a hex hash (of one case) or a base32 hash like produced by
+	// esbuild. Names like jquery-SNAPSHOT1.js or app.Settings2.css are no
+	// hashes.
+	assetHashedNameRegexp = regexp.MustCompile(`[.-]([0-9a-f]{8,}|[0-9A-F]{8,}|[A-Z2-7]{8})\.[A-Za-z0-9]+$`)
+	assetHashRegexp       = regexp.MustCompile(`[0-9]`)
+)
+
+func newAssetCache(srv *server) *assetCache {
+	result := &assetCache{
+		server:  srv,
+		entries: map[string]*assetEntry{},
+	}
+	result.client.Timeout = assetFetchTimeout
+	result.client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return result
+}
+
+// assetCache holds the static assets of the GUIs of the current release in
+// memory. It is cleared as soon as the release changes.
+type assetCache struct {
+	server *server
+	client http.Client
+
+	mutex   sync.Mutex
+	release string
+	entries map[string]*assetEntry
+	size    int
+	// uncacheable is the number of entries which are uncacheable.
+	uncacheable int
+}
+
+type assetEntry struct {
+	contentType  string
+	lastModified string
+	body         []byte
+	hash         string
+	// uncacheable is set for assets which are too large to be cached or
+	// which the upstream does not answer with a cacheable response (like a
+	// 404). Those are proxied right away next time.
+	uncacheable bool
+	// variants contains the bodies rewritten for a prefix and compressed
+	// with an encoding; so each of them is only created once per release.
+	variants map[assetVariantKey][]byte
+}
+
+type assetVariantKey struct {
+	prefix   string
+	encoding contentEncoding
+}
+
+func isCacheableAsset(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	default:
+		return false
+	}
+	if r.URL.RawQuery != "" || r.Header.Get("Range") != "" {
+		return false
+	}
+	if guiOfPath(r.URL.Path) == "" {
+		return false
+	}
+	switch strings.ToLower(path.Ext(r.URL.Path)) {
+	case "", ".html", ".htm":
+		// Documents are rewritten per user (like the GUI switcher).
+		return false
+	default:
+		return true
+	}
+}
+
+func isHashedAssetName(p string) bool {
+	m := assetHashedNameRegexp.FindStringSubmatch(path.Base(p))
+	return m != nil && assetHashRegexp.MatchString(m[1])
+}
+
+// serve answers the request from the cache (which is filled on demand). It
+// returns false if the asset cannot be served from the cache; the request
+// has to be proxied as usual then.
+func (ac *assetCache) serve(rw http.ResponseWriter, r *http.Request) bool {
+	release := ac.server.state.getRelease()
+	entry, err := ac.get(r, release)
+	if err != nil {
+		ac.server.loggerOf(r).WithError(err).
+			With("uri", r.URL.Path).
+			Debug("cannot cache asset; proxy it instead")
+		return false
+	}
+	if entry.uncacheable {
+		return false
+	}
+
+	key := assetVariantKey{prefix: prefixOf(r)}
+	compressible := ac.server.options.compression && isCompressibleContentType(entry.contentType)
+	if compressible && len(entry.body) >= compressionMinSize {
+		key.encoding = negotiateContentEncoding(r.Header.Get("Accept-Encoding"))
+	}
+	body, err := ac.variant(r.URL.Path, entry, key)
+	if err != nil {
+		ac.server.loggerOf(r).WithError(err).
+			With("uri", r.URL.Path).
+			Debug("cannot create variant of asset; proxy it instead")
+		return false
+	}
+	// Each encoding is another representation; so it needs its own ETag.
+	etagSum := sha256.Sum256([]byte(release + "\x00" + entry.hash + "\x00" + key.prefix + "\x00" + string(key.encoding)))
+	etag := `"` + hex.EncodeToString(etagSum[:16]) + `"`
+
+	h := rw.Header()
+	h.Set("ETag", etag)
+	if compressible {
+		addVary(h, "Accept-Encoding")
+	}
+	if key.encoding != contentEncodingIdentity {
+		h.Set("Content-Encoding", string(key.encoding))
+	}
+	if isHashedAssetName(r.URL.Path) {
+		h.Set("Cache-Control", assetCacheControlImmutable)
+	} else {
+		h.Set("Cache-Control", assetCacheControlRevalidate)
+	}
+	if entry.contentType != "" {
+		h.Set("Content-Type", entry.contentType)
+	}
+	if entry.lastModified != "" {
+		h.Set("Last-Modified", entry.lastModified)
+	}
+	if ac.server.options.securityHeaders {
+		ac.server.applySecurityHeaders(h)
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = rw.Write(body)
+	}
+	return true
+}
+
+func (ac *assetCache) get(r *http.Request, release string) (*assetEntry, error) {
+	key := r.URL.Path
+
+	ac.mutex.Lock()
+	if ac.release != release {
+		ac.entries, ac.size, ac.uncacheable, ac.release = map[string]*assetEntry{}, 0, 0, release
+	}
+	entry := ac.entries[key]
+	ac.mutex.Unlock()
+	if entry != nil {
+		return entry, nil
+	}
+
+	entry, err := ac.fetch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.release != release {
+		return entry, nil
+	}
+	if entry.uncacheable {
+		if ac.uncacheable < assetCacheMaxUncacheable {
+			ac.entries[key] = entry
+			ac.uncacheable++
+		}
+	} else if ac.size+len(entry.body) <= assetCacheMaxSize {
+		ac.entries[key] = entry
+		ac.size += len(entry.body)
+	}
+	return entry, nil
+}
+
+// variant returns the body of the given entry rewritten for the prefix and
+// compressed with the encoding of the given key. It is kept with the entry (as
+// long as it belongs to the current release) for the next requests.
+func (ac *assetCache) variant(path string, entry *assetEntry, key assetVariantKey) ([]byte, error) {
+	if key == (assetVariantKey{}) {
+		return entry.body, nil
+	}
+
+	ac.mutex.Lock()
+	b, ok := entry.variants[key]
+	ac.mutex.Unlock()
+	if ok {
+		return b, nil
+	}
+
+	b = entry.body
+	if key.prefix != "" {
+		for _, rule := range rewriteRulesFor(path, entry.contentType) {
+			b = rule.apply(b, key.prefix)
+		}
+	}
+	b, err := key.encoding.encode(b)
+	if err != nil {
+		return nil, err
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+	if ac.entries[path] == entry && len(entry.variants) < assetCacheMaxVariants && ac.size+len(b) <= assetCacheMaxSize {
+		if entry.variants == nil {
+			entry.variants = map[assetVariantKey][]byte{}
+		}
+		entry.variants[key] = b
+		ac.size += len(b)
+	}
+	return b, nil
+}
+
+func (ac *assetCache) fetch(r *http.Request) (*assetEntry, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, ac.server.upstreamUrl.String()+r.URL.Path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request to upstream: %w", err)
+	}
+	req.Header.Set("Authorization", "PreAuth "+ac.server.options.webservicePreAuthTokens)
+	req.Header.Set(requestIdHeader, requestIdOf(r))
+
+	rsp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot request asset from upstream: %w", err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		// Might be temporary; try again next time.
+		return nil, fmt.Errorf("upstream responded with unexpected status %d", rsp.StatusCode)
+	}
+	if rsp.StatusCode != http.StatusOK || strings.Contains(rsp.Header.Get("Cache-Control"), "no-store") {
+		return &assetEntry{uncacheable: true}, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(rsp.Body, assetCacheMaxEntrySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read asset from upstream: %w", err)
+	}
+	if len(b) > assetCacheMaxEntrySize {
+		return &assetEntry{uncacheable: true}, nil
+	}
+	sum := sha256.Sum256(b)
+	return &assetEntry{
+		contentType:  rsp.Header.Get("Content-Type"),
+		lastModified: rsp.Header.Get("Last-Modified"),
+		body:         b,
+		hash:         hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
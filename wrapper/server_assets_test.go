@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+var testAssetBody = []byte(strings.Repeat(`window.location.href="/ngclient/settings";`, 100))
+
+func newAssetTestServer(t *testing.T) (*server, *atomic.Int32) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write(testAssetBody)
+	}))
+	t.Cleanup(upstream.Close)
+
+	srv := &server{
+		options: options{compression: true},
+		logger:  log.GetLogger("test"),
+		state:   newState(),
+	}
+	srv.state.setRelease("release-1")
+	var err error
+	if srv.upstreamUrl, err = url.Parse(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	srv.assets = newAssetCache(srv)
+	return srv, &requests
+}
+
+func serveTestAsset(t *testing.T, srv *server, prefix, acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/ngclient/main-3Q2NKL4D.js", nil)
+	r = r.WithContext(withPrefix(r.Context(), prefix))
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	if ifNoneMatch != "" {
+		r.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rw := httptest.NewRecorder()
+	if !srv.assets.serve(rw, r) {
+		t.Fatal("expected asset to be served from cache")
+	}
+	return rw
+}
+
+func Test_assetCache_serve_encodings(t *testing.T) {
+	srv, requests := newAssetTestServer(t)
+	const prefix = "/api/hassio_ingress/abc"
+	expected := bytes.ReplaceAll(testAssetBody, []byte(`"/ngclient/`), []byte(`"`+prefix+`/ngclient/`))
+
+	etags := map[string]contentEncoding{}
+	for _, c := range []struct {
+		acceptEncoding string
+		expected       contentEncoding
+	}{
+		{"br, gzip", contentEncodingBrotli},
+		{"gzip", contentEncodingGzip},
+		{"", contentEncodingIdentity},
+	} {
+		t.Run(c.acceptEncoding, func(t *testing.T) {
+			first := serveTestAsset(t, srv, prefix, c.acceptEncoding, "")
+			second := serveTestAsset(t, srv, prefix, c.acceptEncoding, "")
+
+			if actual := first.Header().Get("Content-Encoding"); actual != string(c.expected) {
+				t.Errorf("expected Content-Encoding %q; but got: %q", c.expected, actual)
+			}
+			if actual := first.Header().Get("Vary"); actual != "Accept-Encoding" {
+				t.Errorf("expected Vary Accept-Encoding; but got: %q", actual)
+			}
+			decoded, err := c.expected.decode(first.Body.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, expected) {
+				t.Errorf("expected rewritten body; but got: %s", decoded)
+			}
+			if !bytes.Equal(first.Body.Bytes(), second.Body.Bytes()) {
+				t.Errorf("expected the same body for the same encoding")
+			}
+
+			etag := first.Header().Get("ETag")
+			if strings.HasPrefix(etag, "W/") {
+				t.Errorf("expected strong ETag; but got: %s", etag)
+			}
+			if other, ok := etags[etag]; ok {
+				t.Errorf("expected ETag of %q to differ from the one of %q", c.expected, other)
+			}
+			etags[etag] = c.expected
+			if actual := second.Header().Get("ETag"); actual != etag {
+				t.Errorf("expected the same ETag for the same encoding; but got: %s and %s", etag, actual)
+			}
+			if rw := serveTestAsset(t, srv, prefix, c.acceptEncoding, etag); rw.Code != http.StatusNotModified {
+				t.Errorf("expected 304 for the ETag of the encoding; but got: %d", rw.Code)
+			}
+		})
+	}
+
+	if actual := requests.Load(); actual != 1 {
+		t.Errorf("expected asset to be fetched once; but got: %d", actual)
+	}
+}
+
+func Test_assetCache_serve_keepsVariants(t *testing.T) {
+	srv, _ := newAssetTestServer(t)
+
+	first := serveTestAsset(t, srv, "/prefix", "br", "")
+
+	entry := srv.assets.entries["/ngclient/main-3Q2NKL4D.js"]
+	if entry == nil {
+		t.Fatal("expected asset to be cached")
+	}
+	cached, ok := entry.variants[assetVariantKey{"/prefix", contentEncodingBrotli}]
+	if !ok {
+		t.Fatalf("expected compressed variant to be cached; but got: %v", entry.variants)
+	}
+	if !bytes.Equal(cached, first.Body.Bytes()) {
+		t.Errorf("expected cached variant to be served")
+	}
+
+	// The cached variant is served as it is; it is not compressed again.
+	entry.variants[assetVariantKey{"/prefix", contentEncodingBrotli}] = []byte("cached")
+	if actual := serveTestAsset(t, srv, "/prefix", "br", "").Body.String(); actual != "cached" {
+		t.Errorf("expected cached variant to be served; but got: %q", actual)
+	}
+
+	// Another release drops every variant.
+	srv.state.setRelease("release-2")
+	if actual := serveTestAsset(t, srv, "/prefix", "br", "").Body.String(); actual == "cached" {
+		t.Errorf("expected variant of old release to be dropped")
+	}
+}
+
+func Test_assetCache_serve_limitsVariants(t *testing.T) {
+	srv, _ := newAssetTestServer(t)
+	for i := 0; i < assetCacheMaxVariants*2; i++ {
+		serveTestAsset(t, srv, "/prefix"+strings.Repeat("x", i), "gzip", "")
+	}
+	entry := srv.assets.entries["/ngclient/main-3Q2NKL4D.js"]
+	if actual := len(entry.variants); actual != assetCacheMaxVariants {
+		t.Errorf("expected %d variants; but got: %d", assetCacheMaxVariants, actual)
+	}
+}
+
+func Test_assetCache_serve_withoutCompression(t *testing.T) {
+	srv, _ := newAssetTestServer(t)
+	srv.options.compression = false
+
+	rw := serveTestAsset(t, srv, "", "br, gzip", "")
+
+	if actual := rw.Header().Get("Content-Encoding"); actual != "" {
+		t.Errorf("expected no Content-Encoding; but got: %q", actual)
+	}
+	if !bytes.Equal(rw.Body.Bytes(), testAssetBody) {
+		t.Errorf("expected original body")
+	}
+}
+
+func Test_addVary(t *testing.T) {
+	h := http.Header{}
+	addVary(h, "Accept-Encoding")
+	addVary(h, "accept-encoding")
+	h.Add("Vary", "Origin")
+	addVary(h, "Accept-Encoding")
+	if actual := h.Values("Vary"); len(actual) != 2 {
+		t.Errorf("expected Accept-Encoding once; but got: %q", actual)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditLogFileDefault    = "/data/audit.jsonl"
+	auditLogFileEnvVar     = "AUDIT_LOG_FILE"
+	auditLogMaxSize        = 5 * 1024 * 1024
+	auditLogMaxBackups     = 3
+	auditBodyLimit         = 64 * 1024
+	auditViewLimitDefault  = 200
+	auditViewLimitMax      = 5000
+	auditRedactedValue     = "***"
+	auditPathPrefix        = "/api/"
+	auditIgnoredPathPrefix = "/api/v1/auth/"
+)
+
+var (
+	auditJobIdRegexp      = regexp.MustCompile(`^/api/v1/backup/([^/]+)`)
+	auditSecretNameRegexp = regexp.MustCompile(`(?i)pass|secret|token|credential|auth|key|cookie|private`)
+)
+
+type auditEntry struct {
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	Route           string    `json:"route"`
+	JobId           string    `json:"jobId,omitempty"`
+	UserId          string    `json:"userId,omitempty"`
+	User            string    `json:"user,omitempty"`
+	UserDisplayName string    `json:"userDisplayName,omitempty"`
+	Remote          string    `json:"remote,omitempty"`
+	Status          int       `json:"status"`
+	Duration        int64     `json:"durationMs"`
+	Body            any       `json:"body,omitempty"`
+	BodyTruncated   bool      `json:"bodyTruncated,omitempty"`
+}
+
+func newAuditLog(opt options) (*auditLog, error) {
+	if !opt.auditLog {
+		return nil, nil
+	}
+	fn := auditLogFileDefault
+	if v := os.Getenv(auditLogFileEnvVar); v != "" {
+		fn = v
+	}
+	f, err := newRotatingFile(fn, auditLogMaxSize, auditLogMaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	return &auditLog{f}, nil
+}
+
+type auditLog struct {
+	file *rotatingFile
+}
+
+// isAuditable reports whether the request might modify something inside of
+// Duplicati and therefore has to be recorded.
+func (al *auditLog) isAuditable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	p := accessPathOf(r) + "/"
+	return strings.HasPrefix(p, auditPathPrefix) &&
+		!strings.HasPrefix(p, auditIgnoredPathPrefix)
+}
+
+// begin creates the entry for the given request. The request body is
+// captured (redacted) without consuming it for the upstream.
+func (al *auditLog) begin(r *http.Request) *auditEntry {
+	id, name := userOf(r)
+	route := accessPathOf(r)
+	result := &auditEntry{
+		Time:            time.Now(),
+		Method:          r.Method,
+		Route:           route,
+		UserId:          id,
+		User:            name,
+		UserDisplayName: r.Header.Get("X-Remote-User-Display-Name"),
+		Remote:          r.RemoteAddr,
+	}
+	if m := auditJobIdRegexp.FindStringSubmatch(route); m != nil {
+		result.JobId = m[1]
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		b, err := io.ReadAll(io.LimitReader(r.Body, auditBodyLimit+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+		if err == nil && len(b) > auditBodyLimit {
+			result.BodyTruncated = true
+		} else if err == nil && len(b) > 0 {
+			result.Body = redactBody(r.Header.Get("Content-Type"), b)
+		}
+	}
+	return result
+}
+
+func (al *auditLog) record(entry *auditEntry, status int) error {
+	entry.Status = status
+	entry.Duration = time.Since(entry.Time).Milliseconds()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit entry: %w", err)
+	}
+	if _, err := al.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("cannot write audit entry: %w", err)
+	}
+	return nil
+}
+
+// read returns the latest entries (newest first) which are accepted by the
+// given filter.
+func (al *auditLog) read(limit int, filter func(*auditEntry) bool) ([]auditEntry, error) {
+	result := make([]auditEntry, 0, limit)
+	fns := []string{al.file.fn}
+	for i := 1; i <= al.file.maxBackups; i++ {
+		fns = append(fns, al.file.backupName(i))
+	}
+	for _, fn := range fns {
+		entries, err := readAuditFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if filter(&entries[i]) {
+				result = append(result, entries[i])
+				if len(result) >= limit {
+					return result, nil
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+func (al *auditLog) Close() error {
+	return al.file.Close()
+}
+
+func readAuditFile(fn string) ([]auditEntry, error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log %q: %w", fn, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var result []auditEntry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, auditBodyLimit*8)
+	for s.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			// Broken lines (e.g. after a crash) are skipped.
+			continue
+		}
+		result = append(result, entry)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read audit log %q: %w", fn, err)
+	}
+	return result, nil
+}
+
+func redactBody(contentType string, b []byte) any {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return nil
+		}
+		result := make(map[string]any, len(values))
+		for k, vs := range values {
+			if auditSecretNameRegexp.MatchString(k) {
+				result[k] = auditRedactedValue
+			} else if len(vs) == 1 {
+				result[k] = redactString(vs[0])
+			} else {
+				result[k] = redactJson(anySliceOf(vs))
+			}
+		}
+		return result
+	default:
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			// Everything else could contain anything; so we do not record it.
+			return nil
+		}
+		return redactJson(v)
+	}
+}
+
+func redactJson(v any) any {
+	switch tv := v.(type) {
+	case map[string]any:
+		// Duplicati transports settings (like the passphrase) as
+		// {"Name": "passphrase", "Value": "..."}.
+		if name, ok := tv["Name"].(string); ok && auditSecretNameRegexp.MatchString(name) {
+			if _, ok := tv["Value"]; ok {
+				tv["Value"] = auditRedactedValue
+			}
+		}
+		for k, e := range tv {
+			if auditSecretNameRegexp.MatchString(k) {
+				tv[k] = auditRedactedValue
+			} else {
+				tv[k] = redactJson(e)
+			}
+		}
+		return tv
+	case []any:
+		for i, e := range tv {
+			tv[i] = redactJson(e)
+		}
+		return tv
+	case string:
+		return redactString(tv)
+	default:
+		return v
+	}
+}
+
+// redactString masks credentials which are part of URLs, like the target URLs
+// of backups (s3://bucket?auth-username=foo&auth-password=bar).
+func redactString(v string) string {
+	if !strings.Contains(v, "://") && !strings.Contains(v, "?") {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return auditRedactedValue
+	}
+	modified := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), auditRedactedValue)
+			modified = true
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for k := range query {
+			if auditSecretNameRegexp.MatchString(k) {
+				query.Set(k, auditRedactedValue)
+				modified = true
+			}
+		}
+		if modified {
+			u.RawQuery = strings.ReplaceAll(query.Encode(), url.QueryEscape(auditRedactedValue), auditRedactedValue)
+		}
+	}
+	if !modified {
+		return v
+	}
+	return u.String()
+}
+
+func anySliceOf(in []string) []any {
+	result := make([]any, len(in))
+	for i, v := range in {
+		result[i] = v
+	}
+	return result
+}
+
+// handleAudited executes next and records the request to the audit log, if
+// required.
+func (srv *server) handleAudited(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	al := srv.audit
+	if al == nil || !al.isAuditable(r) {
+		next(rw, r)
+		return
+	}
+	entry := al.begin(r)
+	arw := &httpResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+	defer func() {
+		if err := al.record(entry, arw.status); err != nil {
+			srv.loggerOf(r).WithError(err).Error()
+		}
+	}()
+	next(arw, r)
+}
+
+var (
+	//go:embed server_audit.html
+	auditPageHtml string
+
+	auditPageTemplate = template.Must(template.New("audit").Parse(auditPageHtml))
+)
+
+func (srv *server) handlerAudit(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	default:
+		http.Error(rw, "Bad Request", http.StatusMethodNotAllowed)
+		return
+	}
+	if srv.audit == nil {
+		http.Error(rw, "Audit log is disabled", http.StatusNotFound)
+		return
+	}
+	if role := srv.roleOf(r); !role.permits(roleAdmin) {
+		id, name := userOf(r)
+		srv.loggerOf(r).With("userId", id).
+			With("user", name).
+			With("role", role).
+			Warn("access to audit log denied")
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := auditViewLimitDefault
+	if v, err := strconv.Atoi(q.Get("limit")); err == nil && v > 0 {
+		limit = min(v, auditViewLimitMax)
+	}
+	job, user := q.Get("job"), q.Get("user")
+	entries, err := srv.audit.read(limit, func(entry *auditEntry) bool {
+		if job != "" && entry.JobId != job {
+			return false
+		}
+		if user != "" && !strings.EqualFold(entry.User, user) && !strings.EqualFold(entry.UserId, user) {
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		srv.loggerOf(r).WithError(err).Error()
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	if wantsJson(r) || q.Get("format") == "json" {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		enc := json.NewEncoder(rw)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(entries)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := auditPageTemplate.Execute(rw, auditPagePayload{entries}); err != nil {
+		srv.loggerOf(r).WithError(err).Warn("cannot render audit page")
+	}
+}
+
+type auditPagePayload struct {
+	Entries []auditEntry
+}
+
+func (p auditPagePayload) BodyOf(entry auditEntry) string {
+	if entry.Body == nil {
+		return ""
+	}
+	b, err := json.Marshal(entry.Body)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
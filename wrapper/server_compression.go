@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	compressionMinSize = 1024
+)
+
+var (
+	// compressionEncodings contains the encodings the wrapper compresses
+	// responses with, in order of preference.
+	compressionEncodings = []contentEncoding{contentEncodingBrotli, contentEncodingGzip}
+
+	compressibleContentTypes = []string{
+		"application/json",
+		"application/javascript",
+		"application/x-javascript",
+		"application/xml",
+		"application/xhtml+xml",
+		"application/manifest+json",
+		"application/vnd.ms-fontobject",
+		"image/svg+xml",
+		"image/x-icon",
+		"font/ttf",
+		"font/otf",
+	}
+)
+
+// negotiateContentEncoding selects the encoding out of compressionEncodings
+// which is accepted by the given Accept-Encoding header with the highest
+// quality.
+func negotiateContentEncoding(header string) contentEncoding {
+	qualities := map[string]float64{}
+	for _, candidate := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(candidate, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if pq, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = pq
+			}
+		}
+		qualities[name] = q
+	}
+
+	result, best := contentEncodingIdentity, 0.0
+	for _, candidate := range compressionEncodings {
+		q, ok := qualities[string(candidate)]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > best {
+			result, best = candidate, q
+		}
+	}
+	return result
+}
+
+func isCompressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == "text/event-stream" {
+		// Events have to reach the client immediately.
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, candidate := range compressibleContentTypes {
+		if mediaType == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds the given header name to Vary, if it is not already present.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, candidate := range strings.Split(v, ",") {
+			if c := strings.TrimSpace(candidate); c == "*" || strings.EqualFold(c, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// newCompressingResponseWriter returns nil if the response of the given
+// request cannot be compressed at all.
+func newCompressingResponseWriter(rw http.ResponseWriter, r *http.Request) *compressingResponseWriter {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Method == http.MethodHead {
+		return nil
+	}
+	encoding := negotiateContentEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == contentEncodingIdentity {
+		return nil
+	}
+	return &compressingResponseWriter{
+		ResponseWriter: rw,
+		encoding:       encoding,
+	}
+}
+
+// compressingResponseWriter compresses the response body, if the response is
+// eligible for it. This is decided by the headers of the response once they
+// are written.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	encoding    contentEncoding
+	wroteHeader bool
+	w           io.WriteCloser
+}
+
+func (crw *compressingResponseWriter) shouldCompress(status int) bool {
+	if status < 200 || status >= 300 || status == http.StatusNoContent || status == http.StatusPartialContent {
+		return false
+	}
+	h := crw.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(h.Get("Content-Disposition"))), "attachment") {
+		// Downloads (like restored files) are streamed as they are.
+		return false
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		if l, err := strconv.ParseInt(v, 10, 64); err == nil && l < compressionMinSize {
+			return false
+		}
+	}
+	return isCompressibleContentType(h.Get("Content-Type"))
+}
+
+func (crw *compressingResponseWriter) WriteHeader(status int) {
+	if crw.wroteHeader {
+		crw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	crw.wroteHeader = true
+	h := crw.Header()
+	if isCompressibleContentType(h.Get("Content-Type")) {
+		addVary(h, "Accept-Encoding")
+	}
+	if crw.shouldCompress(status) {
+		if w, err := crw.encoding.writer(crw.ResponseWriter); err == nil {
+			crw.w = w
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", string(crw.encoding))
+			// The compressed representation is not byte-identical anymore.
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	crw.ResponseWriter.WriteHeader(status)
+}
+
+func (crw *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !crw.wroteHeader {
+		crw.WriteHeader(http.StatusOK)
+	}
+	if crw.w != nil {
+		return crw.w.Write(b)
+	}
+	return crw.ResponseWriter.Write(b)
+}
+
+func (crw *compressingResponseWriter) Flush() {
+	if f, ok := crw.w.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	_ = http.NewResponseController(crw.ResponseWriter).Flush()
+}
+
+func (crw *compressingResponseWriter) Close() error {
+	if crw.w == nil {
+		return nil
+	}
+	return crw.w.Close()
+}
+
+func (crw *compressingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := crw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("can't switch protocols using non-Hijacker ResponseWriter type %T", crw.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+func (crw *compressingResponseWriter) Unwrap() http.ResponseWriter {
+	return crw.ResponseWriter
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+func (srv *server) isStateChanging(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		// Websocket handshakes are GET requests, but browsers do not apply
+		// the same origin policy to them.
+		return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+	default:
+		return true
+	}
+}
+
+// checkRequestOrigin ensures that state-changing requests were initiated by a
+// page served by ourselves and that the requested host is an expected one.
+func (srv *server) checkRequestOrigin(r *http.Request, direct bool) error {
+	if direct && !srv.isConfiguredHost(hostnameOf(r.Host)) {
+		return fmt.Errorf("host %q is not allowed", r.Host)
+	}
+
+	if !srv.isStateChanging(r) {
+		return nil
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if referer := r.Header.Get("Referer"); referer != "" {
+			origin = referer
+		}
+	}
+	if origin == "" {
+		// Requests of modern browsers always contain Sec-Fetch-Site; other
+		// clients (like scripts) cannot be abused via CSRF.
+		if strings.EqualFold(r.Header.Get("Sec-Fetch-Site"), "cross-site") {
+			return fmt.Errorf("cross-site request without origin")
+		}
+		return nil
+	}
+	if origin == "null" {
+		return fmt.Errorf("request of opaque origin")
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("illegal origin %q", origin)
+	}
+	if !srv.isAllowedHost(hostnameOf(u.Host), r) {
+		return fmt.Errorf("cross-site request of origin %q", origin)
+	}
+	return nil
+}
+
+func (srv *server) isAllowedHost(hostname string, r *http.Request) bool {
+	if hostname == "" {
+		return false
+	}
+	if strings.EqualFold(hostname, hostnameOf(r.Host)) {
+		return true
+	}
+	if srv.isIngressSource(r) || srv.isTrustedProxy(r) {
+		if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+			v, _, _ = strings.Cut(v, ",")
+			if strings.EqualFold(hostname, hostnameOf(strings.TrimSpace(v))) {
+				return true
+			}
+		}
+	}
+	for _, candidate := range srv.allowedHosts {
+		if strings.EqualFold(hostname, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// isConfiguredHost reports whether hostname was configured via allowed_hosts.
+// If nothing is configured, every hostname is accepted. IP addresses are
+// always accepted, because these cannot be abused for DNS rebinding.
+func (srv *server) isConfiguredHost(hostname string) bool {
+	if len(srv.allowedHosts) == 0 || isIpHostname(hostname) {
+		return true
+	}
+	for _, candidate := range srv.allowedHosts {
+		if strings.EqualFold(hostname, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *server) rejectCrossSite(rw http.ResponseWriter, r *http.Request, err error) {
+	srv.loggerOf(r).WithError(err).
+		With("uri", r.RequestURI).
+		With("method", r.Method).
+		With("remote", r.RemoteAddr).
+		Warn("rejected request which failed host/origin validation")
+	if wantsJson(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprint(rw, `{"Error":"Cross-site request rejected"}`)
+		return
+	}
+	http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func hostnameOf(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return strings.Trim(host, "[]")
+	}
+	return strings.Trim(hostport, "[]")
+}
+
+func isIpHostname(hostname string) bool {
+	_, err := netip.ParseAddr(hostname)
+	return err == nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func Test_server_checkRequestOrigin(t *testing.T) {
+	const (
+		ingress = "172.30.32.2:40000"
+		proxy   = "10.0.0.5:40000"
+		other   = "192.168.1.20:40000"
+	)
+	cases := []struct {
+		name         string
+		remote       string
+		method       string
+		host         string
+		headers      map[string]string
+		direct       bool
+		allowedHosts []string
+		expectedOk   bool
+	}{
+		// Requests which cannot change anything are never checked.
+		{name: "getWithForeignOrigin", remote: other, method: http.MethodGet, host: "ha.local:8123", headers: map[string]string{"Origin": "https://evil.com"}, expectedOk: true},
+		{name: "headWithForeignOrigin", remote: other, method: http.MethodHead, host: "ha.local:8123", headers: map[string]string{"Origin": "https://evil.com"}, expectedOk: true},
+
+		// Ingress: the browser talks to Home Assistant, which forwards the
+		// host it was requested with.
+		{name: "ingressSameHost", remote: ingress, method: http.MethodPost, host: "ha.local:8123", headers: map[string]string{"Origin": "http://ha.local:8123"}, expectedOk: true},
+		{name: "ingressForwardedHost", remote: ingress, method: http.MethodPost, host: "172.30.33.1:8099", headers: map[string]string{"Origin": "https://ha.example.com", "X-Forwarded-Host": "ha.example.com"}, expectedOk: true},
+		{name: "ingressForwardedHostChain", remote: ingress, method: http.MethodPost, host: "172.30.33.1:8099", headers: map[string]string{"Origin": "https://ha.example.com", "X-Forwarded-Host": "ha.example.com, inner.local"}, expectedOk: true},
+		{name: "ingressForeignOrigin", remote: ingress, method: http.MethodPost, host: "172.30.33.1:8099", headers: map[string]string{"Origin": "https://evil.com", "X-Forwarded-Host": "ha.example.com"}, expectedOk: false},
+		{name: "ingressDelete", remote: ingress, method: http.MethodDelete, host: "172.30.33.1:8099", headers: map[string]string{"Origin": "https://evil.com"}, expectedOk: false},
+
+		// Trusted proxies are allowed to tell the host as well.
+		{name: "proxyForwardedHost", remote: proxy, method: http.MethodPost, host: "10.0.0.2:8080", headers: map[string]string{"Origin": "https://duplicati.example.com", "X-Forwarded-Host": "duplicati.example.com"}, expectedOk: true},
+
+		// Everybody else cannot choose which host is accepted.
+		{name: "spoofedForwardedHost", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "https://evil.com", "X-Forwarded-Host": "evil.com"}, direct: true, expectedOk: false},
+		{name: "directSameHost", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "http://192.168.1.10:8081"}, direct: true, expectedOk: true},
+		{name: "directSameHostOtherPort", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "http://192.168.1.10:9999"}, direct: true, expectedOk: true},
+		{name: "directIpv6", remote: "[fd00::20]:40000", method: http.MethodPost, host: "[fd00::10]:8081", headers: map[string]string{"Origin": "http://[fd00::10]:8081"}, direct: true, expectedOk: true},
+
+		// Without Origin the Referer is used.
+		{name: "refererSameHost", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Referer": "http://192.168.1.10:8081/ngclient/"}, direct: true, expectedOk: true},
+		{name: "refererForeign", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Referer": "https://evil.com/page"}, direct: true, expectedOk: false},
+		{name: "originBeforeReferer", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "https://evil.com", "Referer": "http://192.168.1.10:8081/"}, direct: true, expectedOk: false},
+
+		// Without both, only browsers which say it is cross-site are rejected.
+		{name: "noOriginScript", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", direct: true, expectedOk: true},
+		{name: "noOriginSameOrigin", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, direct: true, expectedOk: true},
+		{name: "noOriginCrossSite", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Sec-Fetch-Site": "cross-site"}, direct: true, expectedOk: false},
+		{name: "opaqueOrigin", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "null"}, direct: true, expectedOk: false},
+		{name: "illegalOrigin", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "not a url"}, direct: true, expectedOk: false},
+
+		// Websocket handshakes are GET requests, but are not protected by the
+		// same origin policy of browsers.
+		{name: "websocketSameHost", remote: ingress, method: http.MethodGet, host: "ha.local:8123", headers: map[string]string{"Upgrade": "websocket", "Origin": "http://ha.local:8123"}, expectedOk: true},
+		{name: "websocketForeignOrigin", remote: ingress, method: http.MethodGet, host: "ha.local:8123", headers: map[string]string{"Upgrade": "WebSocket", "Origin": "https://evil.com"}, expectedOk: false},
+		{name: "websocketDirectForeignOrigin", remote: other, method: http.MethodGet, host: "192.168.1.10:8081", headers: map[string]string{"Upgrade": "websocket", "Origin": "https://evil.com"}, direct: true, expectedOk: false},
+
+		// allowed_hosts restricts the host of the direct access port (against
+		// DNS rebinding) and adds further accepted origins.
+		{name: "allowedHost", remote: other, method: http.MethodGet, host: "duplicati.example.com:8081", direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: true},
+		{name: "allowedHostOtherCase", remote: other, method: http.MethodGet, host: "Duplicati.Example.com", direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: true},
+		{name: "notAllowedHost", remote: other, method: http.MethodGet, host: "rebind.evil.com:8081", direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: false},
+		{name: "notAllowedHostViaIngress", remote: ingress, method: http.MethodGet, host: "rebind.evil.com:8081", allowedHosts: []string{"duplicati.example.com"}, expectedOk: true},
+		{name: "ipHostAlwaysAllowed", remote: other, method: http.MethodGet, host: "192.168.1.10:8081", direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: true},
+		{name: "allowedHostAsOrigin", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "https://duplicati.example.com"}, direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: true},
+		{name: "notAllowedHostAsOrigin", remote: other, method: http.MethodPost, host: "192.168.1.10:8081", headers: map[string]string{"Origin": "https://other.example.com"}, direct: true, allowedHosts: []string{"duplicati.example.com"}, expectedOk: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := &server{
+				ingressSources: []netip.Prefix{netip.MustParsePrefix("172.30.32.2/32")},
+				trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.5/32")},
+				allowedHosts:   c.allowedHosts,
+			}
+			r := httptest.NewRequest(c.method, "http://localhost/api/v1/backup/1/run", nil)
+			r.RemoteAddr = c.remote
+			r.Host = c.host
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+
+			err := srv.checkRequestOrigin(r, c.direct)
+			if c.expectedOk && err != nil {
+				t.Errorf("expected request to be accepted; but got: %v", err)
+			} else if !c.expectedOk && err == nil {
+				t.Errorf("expected request to be rejected; but it was accepted")
+			}
+		})
+	}
+}
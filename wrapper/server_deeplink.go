@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	deepLinkJobParameter  = "job"
+	deepLinkViewParameter = "view"
+)
+
+type deepLinkView string
+
+const (
+	deepLinkViewLog     deepLinkView = "log"
+	deepLinkViewRestore deepLinkView = "restore"
+	deepLinkViewEdit    deepLinkView = "edit"
+)
+
+var (
+	deepLinkJobRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	// deepLinkRoutes contains the routes (relative to optionsGui.initPath)
+	// of each view per GUI. %s is replaced with the ID of the job.
+	deepLinkRoutes = map[optionsGui]map[deepLinkView]string{
+		guiNgax: {
+			deepLinkViewLog:     "index.html#/log/%s",
+			deepLinkViewRestore: "index.html#/restore/%s",
+			deepLinkViewEdit:    "index.html#/edit/%s",
+		},
+		guiNgclient: {
+			deepLinkViewLog:     "backup/%s/log",
+			deepLinkViewRestore: "restore/%s",
+			deepLinkViewEdit:    "backup/%s",
+		},
+	}
+)
+
+func parseDeepLinkView(v string) (deepLinkView, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "log", "logs":
+		return deepLinkViewLog, nil
+	case "restore":
+		return deepLinkViewRestore, nil
+	case "edit":
+		return deepLinkViewEdit, nil
+	default:
+		return "", fmt.Errorf("unknown view %q", v)
+	}
+}
+
+// deepLinkOf returns the route (relative to optionsGui.initPath) the given
+// query points to. It is empty if the query does not contain a deep link.
+func deepLinkOf(gui optionsGui, query url.Values) (string, error) {
+	job, view := query.Get(deepLinkJobParameter), query.Get(deepLinkViewParameter)
+	if job == "" {
+		if view != "" {
+			return "", fmt.Errorf("parameter %q requires parameter %q", deepLinkViewParameter, deepLinkJobParameter)
+		}
+		return "", nil
+	}
+	if !deepLinkJobRegexp.MatchString(job) {
+		return "", fmt.Errorf("illegal job %q", job)
+	}
+	v, err := parseDeepLinkView(view)
+	if err != nil {
+		return "", err
+	}
+	route, ok := deepLinkRoutes[gui][v]
+	if !ok {
+		return "", fmt.Errorf("view %q is not supported by gui %v", v, gui)
+	}
+	return fmt.Sprintf(route, job), nil
+}
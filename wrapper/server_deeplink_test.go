@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+func Test_deepLinkOf(t *testing.T) {
+	cases := []struct {
+		gui           optionsGui
+		query         string
+		expected      string
+		expectedError bool
+	}{
+		{guiNgax, "job=1&view=log", "index.html#/log/1", false},
+		{guiNgax, "job=1&view=restore", "index.html#/restore/1", false},
+		{guiNgax, "job=1&view=edit", "index.html#/edit/1", false},
+		{guiNgclient, "job=1&view=log", "backup/1/log", false},
+		{guiNgclient, "job=1&view=restore", "restore/1", false},
+		{guiNgclient, "job=1&view=edit", "backup/1", false},
+
+		// The log is the default view.
+		{guiNgax, "job=1", "index.html#/log/1", false},
+		{guiNgclient, "job=1", "backup/1/log", false},
+		{guiNgclient, "job=1&view=", "backup/1/log", false},
+		{guiNgclient, "job=1&view=logs", "backup/1/log", false},
+		{guiNgclient, "job=1&view=Restore", "restore/1", false},
+		{guiNgclient, "job=a-B_9", "backup/a-B_9/log", false},
+
+		// Without job there is no deep link.
+		{guiNgax, "", "", false},
+		{guiNgclient, "other=1", "", false},
+		{guiNgax, "view=log", "", true},
+		{guiNgclient, "view=restore", "", true},
+
+		{guiNgax, "job=../x", "", true},
+		{guiNgclient, "job=../x", "", true},
+		{guiNgclient, "job=1%23x", "", true},
+		{guiNgclient, "job=1%2Fx", "", true},
+		{guiNgclient, "job=1%3Fx", "", true},
+		{guiNgclient, "job=%20", "", true},
+		{guiNgax, "job=1&view=delete", "", true},
+		{guiNgclient, "job=1&view=settings", "", true},
+		{"", "job=1", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.gui.String()+" "+c.query, func(t *testing.T) {
+			query, err := url.ParseQuery(c.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := deepLinkOf(c.gui, query)
+			if c.expectedError {
+				if err == nil {
+					t.Errorf("expected error; but got: %q", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_server_handlerIndex_deepLink(t *testing.T) {
+	t.Setenv(guiPreferencesFileEnvVar, filepath.Join(t.TempDir(), "gui.json"))
+	st := newState()
+	st.setRunning(4711)
+	srv := &server{
+		options: options{gui: guiNgclient},
+		logger:  log.GetLogger("test"),
+		state:   st,
+	}
+	srv.upstreamReady.Store(true)
+	var err error
+	if srv.guiPreferences, err = newGuiPreferences(srv.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		target           string
+		prefix           string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"/", "", http.StatusTemporaryRedirect, "/ngclient/"},
+		{"/?job=1&view=restore", "", http.StatusTemporaryRedirect, "/ngclient/restore/1"},
+		{"/?job=1&view=restore", "/api/hassio_ingress/abc", http.StatusTemporaryRedirect, "/api/hassio_ingress/abc/ngclient/restore/1"},
+		{"/?job=2&gui=ngax", "/api/hassio_ingress/abc", http.StatusTemporaryRedirect, "/api/hassio_ingress/abc/ngax/index.html#/log/2"},
+		{"/?job=../x", "/api/hassio_ingress/abc", http.StatusBadRequest, ""},
+		{"/?view=log", "", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.prefix+c.target, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost"+c.target, nil)
+			r = r.WithContext(withPrefix(r.Context(), c.prefix))
+			rw := httptest.NewRecorder()
+
+			srv.handlerIndex(rw, r)
+
+			if rw.Code != c.expectedStatus {
+				t.Errorf("expected status %d; but got: %d", c.expectedStatus, rw.Code)
+			}
+			if actual := rw.Header().Get("Location"); actual != c.expectedLocation {
+				t.Errorf("expected location %q; but got: %q", c.expectedLocation, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	log "github.com/echocat/slf4g"
+)
+
+const (
+	directPort = 8081
+
+	haAuthUrlDefault = "http://supervisor/auth"
+	haAuthUrlEnvVar  = "HA_AUTH_URL"
+
+	directSessionCookie  = "wrapper_session"
+	directSessionTimeout = 12 * time.Hour
+	directAuthTimeout    = 10 * time.Second
+)
+
+var (
+	errDirectUnauthorized = errors.New("invalid username or password")
+
+	//go:embed server_login.html
+	loginPageHtml string
+
+	loginPageTemplate = template.Must(template.New("login").Parse(loginPageHtml))
+)
+
+// newDirectServer creates the login flow of the direct access. Its own
+// listener is only created if listen is set; otherwise it only serves the
+// requests of trusted proxies on the ingress port.
+func newDirectServer(srv *server, listen bool) (ds *directServer, err error) {
+	ds = &directServer{
+		server:    srv,
+		logger:    log.GetLogger("direct"),
+		authUrl:   defaultHaAuthUrl(),
+		authToken: os.Getenv(supervisorTokenEnvVar),
+		sessions:  map[string]directSession{},
+	}
+	ds.client.Timeout = directAuthTimeout
+	ds.impl.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// User headers are only set by ds.handle after a successful login.
+		stripUserHeaders(r)
+		srv.handleWrapperWith(rw, r, ds.handle)
+	})
+	ds.impl.Addr = fmt.Sprintf(":%d", directPort)
+	configureHttpServer(&ds.impl, srv.options)
+	if !listen {
+		return ds, nil
+	}
+
+	if srv.options.ssl {
+		if ds.impl.TLSConfig, err = newTlsConfig(srv.options); err != nil {
+			return nil, fmt.Errorf("cannot configure TLS for direct access: %w", err)
+		}
+	}
+
+	if ds.listener, err = net.Listen("tcp", ds.impl.Addr); err != nil {
+		return nil, fmt.Errorf("cannot listen to %s: %w", ds.impl.Addr, err)
+	}
+	ds.listener = limitListener(ds.listener, srv.options.httpMaxConnections)
+	if ds.impl.TLSConfig != nil {
+		ds.listener = tls.NewListener(ds.listener, ds.impl.TLSConfig)
+	}
+
+	return ds, nil
+}
+
+type directServer struct {
+	server *server
+	logger log.Logger
+
+	authUrl   string
+	authToken string
+	client    http.Client
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]directSession
+
+	impl     http.Server
+	listener net.Listener
+}
+
+type directSession struct {
+	username string
+	expires  time.Time
+}
+
+type directLoginPayload struct {
+	Action   string
+	Redirect string
+	Username string
+	Error    string
+}
+
+func (ds *directServer) serve() error {
+	ds.logger.
+		With("addr", ds.impl.Addr).
+		With("tls", ds.impl.TLSConfig != nil).
+		Info("direct access listening...")
+	err := ds.impl.Serve(ds.listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (ds *directServer) shutdown() error {
+	return ds.impl.Shutdown(context.Background())
+}
+
+func (ds *directServer) handle(rw http.ResponseWriter, r *http.Request) {
+	// Never trust user headers sent by the client itself.
+	stripUserHeaders(r)
+	if isPublicWrapperPath(r.URL.Path) {
+		// No login required; but users which are logged in might see more.
+		if session, ok := ds.sessionOf(r); ok {
+			ds.setUserHeaders(r, session)
+			r = r.WithContext(withDirectSession(r.Context()))
+		}
+		ds.server.handle(rw, r)
+		return
+	}
+	if err := ds.server.checkRequestOrigin(r, true); err != nil {
+		ds.server.rejectCrossSite(rw, r, err)
+		return
+	}
+	switch r.URL.Path {
+	case wrapperPathPrefix + "login":
+		ds.handlerLogin(rw, r)
+		return
+	case wrapperPathPrefix + "logout":
+		ds.handlerLogout(rw, r)
+		return
+	}
+
+	session, ok := ds.sessionOf(r)
+	if !ok {
+		ds.requireLogin(rw, r)
+		return
+	}
+
+	ds.setUserHeaders(r, session)
+	ds.server.handle(rw, r.WithContext(withDirectSession(r.Context())))
+}
+
+func (ds *directServer) setUserHeaders(r *http.Request, session directSession) {
+	stripUserHeaders(r)
+	r.Header.Set("X-Remote-User-Name", session.username)
+}
+
+type directSessionContextKey struct{}
+
+func withDirectSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, directSessionContextKey{}, true)
+}
+
+// isDirectSession reports whether the user of the request logged in on the
+// direct access port (or behind a trusted proxy) instead of using ingress.
+func isDirectSession(r *http.Request) bool {
+	v, _ := r.Context().Value(directSessionContextKey{}).(bool)
+	return v
+}
+
+func (ds *directServer) handlerLogin(rw http.ResponseWriter, r *http.Request) {
+	payload := directLoginPayload{
+		Action:   prefixOf(r) + wrapperPathPrefix + "login",
+		Redirect: sanitizeRedirect(r.FormValue("redirect"), prefixOf(r)),
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		ds.serveLoginPage(rw, r, http.StatusOK, payload)
+	case "POST":
+		payload.Username = r.PostFormValue("username")
+		err := ds.authenticate(r.Context(), payload.Username, r.PostFormValue("password"))
+		if errors.Is(err, errDirectUnauthorized) {
+			ds.loggerOf(r).With("user", payload.Username).
+				With("remote", r.RemoteAddr).
+				Warn("login failed")
+			payload.Error = "Invalid username or password."
+			ds.serveLoginPage(rw, r, http.StatusUnauthorized, payload)
+			return
+		} else if err != nil {
+			ds.loggerOf(r).WithError(err).
+				With("user", payload.Username).
+				Error("cannot authenticate against Home Assistant")
+			payload.Error = "Cannot verify credentials at the moment. Please try again later."
+			ds.serveLoginPage(rw, r, http.StatusBadGateway, payload)
+			return
+		}
+
+		token, err := ds.createSession(payload.Username)
+		if err != nil {
+			ds.loggerOf(r).WithError(err).Error("cannot create session")
+			http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		ds.loggerOf(r).With("user", payload.Username).
+			With("remote", r.RemoteAddr).
+			Info("login succeeded")
+		http.SetCookie(rw, ds.sessionCookie(r, token, directSessionTimeout))
+		http.Redirect(rw, r, payload.Redirect, http.StatusSeeOther)
+	default:
+		http.Error(rw, "Bad Request", http.StatusMethodNotAllowed)
+	}
+}
+
+func (ds *directServer) handlerLogout(rw http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(directSessionCookie); err == nil {
+		if session, ok := ds.sessionOf(r); ok {
+			ds.setUserHeaders(r, session)
+			ds.server.tokens.drop(r)
+		}
+		ds.sessionsMutex.Lock()
+		delete(ds.sessions, c.Value)
+		ds.sessionsMutex.Unlock()
+	}
+	http.SetCookie(rw, ds.sessionCookie(r, "", -1))
+	http.Redirect(rw, r, prefixOf(r)+wrapperPathPrefix+"login", http.StatusSeeOther)
+}
+
+func (ds *directServer) requireLogin(rw http.ResponseWriter, r *http.Request) {
+	if wantsJson(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusUnauthorized)
+		_, _ = fmt.Fprint(rw, `{"Error":"Login required"}`)
+		return
+	}
+	target := prefixOf(r) + wrapperPathPrefix + "login?redirect=" + url.QueryEscape(prefixOf(r)+r.URL.RequestURI())
+	http.Redirect(rw, r, target, http.StatusSeeOther)
+}
+
+func (ds *directServer) serveLoginPage(rw http.ResponseWriter, r *http.Request, status int, payload directLoginPayload) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := loginPageTemplate.Execute(rw, payload); err != nil {
+		ds.loggerOf(r).WithError(err).Warn("cannot render login page")
+	}
+}
+
+func (ds *directServer) authenticate(ctx context.Context, username, password string) error {
+	if username == "" || password == "" {
+		return errDirectUnauthorized
+	}
+	body, err := json.Marshal(map[string]string{
+		"username": username,
+		"password": password,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot encode credentials: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ds.authUrl, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request for home assistant auth %q: %w", ds.authUrl, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ds.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+ds.authToken)
+	}
+
+	rsp, err := ds.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not execute request to home assistant auth %q: %w", ds.authUrl, err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	switch rsp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return errDirectUnauthorized
+	default:
+		return fmt.Errorf("could not execute request to home assistant auth %q: got %d - %s", ds.authUrl, rsp.StatusCode, rsp.Status)
+	}
+}
+
+func (ds *directServer) createSession(username string) (string, error) {
+	token, err := generateSecretString()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+
+	ds.sessionsMutex.Lock()
+	defer ds.sessionsMutex.Unlock()
+	for k, v := range ds.sessions {
+		if now.After(v.expires) {
+			delete(ds.sessions, k)
+		}
+	}
+	ds.sessions[token] = directSession{
+		username: username,
+		expires:  now.Add(directSessionTimeout),
+	}
+	return token, nil
+}
+
+func (ds *directServer) sessionOf(r *http.Request) (directSession, bool) {
+	c, err := r.Cookie(directSessionCookie)
+	if err != nil || c.Value == "" {
+		return directSession{}, false
+	}
+
+	ds.sessionsMutex.Lock()
+	defer ds.sessionsMutex.Unlock()
+	v, ok := ds.sessions[c.Value]
+	if !ok {
+		return directSession{}, false
+	}
+	if time.Now().After(v.expires) {
+		delete(ds.sessions, c.Value)
+		return directSession{}, false
+	}
+	return v, true
+}
+
+func (ds *directServer) sessionCookie(r *http.Request, value string, maxAge time.Duration) *http.Cookie {
+	result := &http.Cookie{
+		Name:     directSessionCookie,
+		Value:    value,
+		Path:     prefixOf(r) + "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		result.MaxAge = -1
+	} else {
+		result.MaxAge = int(maxAge.Seconds())
+	}
+	return result
+}
+
+// sanitizeRedirect only accepts local paths as target after login. Browsers
+// ignore whitespace and control characters in Location (/\t/evil.com becomes
+// //evil.com); so these are rejected, too.
+func sanitizeRedirect(in, prefix string) string {
+	fallback := prefix + "/"
+	if in == "" || strings.ContainsRune(in, '\\') || strings.IndexFunc(in, func(r rune) bool {
+		return unicode.IsControl(r) || unicode.IsSpace(r)
+	}) >= 0 {
+		return fallback
+	}
+	u, err := url.Parse(in)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || u.Opaque != "" {
+		return fallback
+	}
+	if !strings.HasPrefix(in, "/") || strings.HasPrefix(in, "//") || strings.HasPrefix(u.Path, "//") {
+		return fallback
+	}
+	return in
+}
+
+func defaultHaAuthUrl() string {
+	if v := os.Getenv(haAuthUrlEnvVar); v != "" {
+		return v
+	}
+	return haAuthUrlDefault
+}
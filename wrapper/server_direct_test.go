@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/echocat/slf4g"
+)
+
+// newDirectTestServer returns a direct server whose Supervisor auth endpoint
+// is a stand-in: user/secret is valid, the user broken lets it fail and
+// everything else is rejected. Authenticated requests end up at an upstream
+// which answers with the user it was called for.
+func newDirectTestServer(t *testing.T) *directServer {
+	t.Helper()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer supervisor-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var credentials struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case credentials.Username == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case credentials.Username == "user" && credentials.Password == "secret":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(auth.Close)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello " + r.Header.Get("X-Remote-User-Name")))
+	}))
+	t.Cleanup(upstream.Close)
+	t.Setenv(haAuthUrlEnvVar, auth.URL)
+	t.Setenv(supervisorTokenEnvVar, "supervisor-token")
+
+	srv := &server{
+		options: options{
+			accessControl: []optionsAccessControlEntry{
+				{User: "user", Role: roleAdmin},
+			},
+		},
+		logger: log.GetLogger("test"),
+		state:  newState(),
+	}
+	var err error
+	if srv.upstreamUrl, err = url.Parse(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	srv.reverseProxy.Rewrite = func(pr *httputil.ProxyRequest) {
+		pr.SetURL(srv.upstreamUrl)
+	}
+	srv.tokens = newAccessTokens(srv)
+	ds, err := newDirectServer(srv, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+func serveDirect(ds *directServer, method, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	var r *http.Request
+	if form != nil {
+		r = httptest.NewRequest(method, "http://localhost"+target, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, "http://localhost"+target, nil)
+	}
+	r.RemoteAddr = "192.168.1.20:40000"
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	ds.handle(rw, r)
+	return rw
+}
+
+func sessionCookieOf(rw *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == directSessionCookie {
+			return c
+		}
+	}
+	return nil
+}
+
+func loginDirect(t *testing.T, ds *directServer) *http.Cookie {
+	t.Helper()
+	rw := serveDirect(ds, http.MethodPost, wrapperPathPrefix+"login", url.Values{
+		"username": {"user"},
+		"password": {"secret"},
+		"redirect": {"/ngclient/settings"},
+	})
+	if rw.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303; but got: %d", rw.Code)
+	}
+	c := sessionCookieOf(rw)
+	if c == nil || c.Value == "" {
+		t.Fatalf("expected session cookie; but got: %v", rw.Header().Values("Set-Cookie"))
+	}
+	return c
+}
+
+func Test_directServer_handlerLogin_succeeds(t *testing.T) {
+	ds := newDirectTestServer(t)
+
+	rw := serveDirect(ds, http.MethodPost, wrapperPathPrefix+"login", url.Values{
+		"username": {"user"},
+		"password": {"secret"},
+		"redirect": {"/ngclient/settings"},
+	})
+
+	if rw.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303; but got: %d", rw.Code)
+	}
+	if actual := rw.Header().Get("Location"); actual != "/ngclient/settings" {
+		t.Errorf("expected redirect to /ngclient/settings; but got: %s", actual)
+	}
+	c := sessionCookieOf(rw)
+	if c == nil || c.Value == "" {
+		t.Fatalf("expected session cookie; but got: %v", rw.Header().Values("Set-Cookie"))
+	}
+	if !c.HttpOnly || c.SameSite != http.SameSiteLaxMode || c.Path != "/" || c.MaxAge != int(directSessionTimeout.Seconds()) {
+		t.Errorf("expected HttpOnly, SameSite=Lax session cookie for / and the session timeout; but got: %v", c)
+	}
+
+	rw = serveDirect(ds, http.MethodGet, "/api/v1/serverstate", nil, c)
+	if rw.Code != http.StatusOK || rw.Body.String() != "hello user" {
+		t.Errorf("expected request of the user to pass; but got: %d - %s", rw.Code, rw.Body.String())
+	}
+}
+
+func Test_directServer_handlerLogin_fails(t *testing.T) {
+	cases := []struct {
+		name           string
+		username       string
+		password       string
+		expectedStatus int
+		expectedError  string
+	}{
+		{"wrongPassword", "user", "wrong", http.StatusUnauthorized, "Invalid username or password."},
+		{"unknownUser", "other", "secret", http.StatusUnauthorized, "Invalid username or password."},
+		{"emptyPassword", "user", "", http.StatusUnauthorized, "Invalid username or password."},
+		{"authFailing", "broken", "secret", http.StatusBadGateway, "Cannot verify credentials at the moment."},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ds := newDirectTestServer(t)
+
+			rw := serveDirect(ds, http.MethodPost, wrapperPathPrefix+"login", url.Values{
+				"username": {c.username},
+				"password": {c.password},
+			})
+
+			if rw.Code != c.expectedStatus {
+				t.Errorf("expected status %d; but got: %d", c.expectedStatus, rw.Code)
+			}
+			body := rw.Body.String()
+			if !strings.Contains(body, c.expectedError) || !strings.Contains(body, `action="`+wrapperPathPrefix+`login"`) {
+				t.Errorf("expected login page with %q; but got: %s", c.expectedError, body)
+			}
+			if c := sessionCookieOf(rw); c != nil {
+				t.Errorf("expected no session cookie; but got: %v", c)
+			}
+			if actual := len(ds.sessions); actual != 0 {
+				t.Errorf("expected no session; but got: %d", actual)
+			}
+		})
+	}
+}
+
+func Test_directServer_handle_requiresLogin(t *testing.T) {
+	ds := newDirectTestServer(t)
+	cases := []struct {
+		name             string
+		target           string
+		cookie           *http.Cookie
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{"page", "/ngclient/settings?x=1", nil, http.StatusSeeOther, wrapperPathPrefix + "login?redirect=%2Fngclient%2Fsettings%3Fx%3D1"},
+		{"api", "/api/v1/serverstate", nil, http.StatusUnauthorized, ""},
+		{"unknownSession", "/ngclient/", &http.Cookie{Name: directSessionCookie, Value: "unknown"}, http.StatusSeeOther, wrapperPathPrefix + "login?redirect=%2Fngclient%2F"},
+		{"emptySession", "/api/v1/serverstate", &http.Cookie{Name: directSessionCookie, Value: ""}, http.StatusUnauthorized, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cookies []*http.Cookie
+			if c.cookie != nil {
+				cookies = append(cookies, c.cookie)
+			}
+
+			rw := serveDirect(ds, http.MethodGet, c.target, nil, cookies...)
+
+			if rw.Code != c.expectedStatus {
+				t.Errorf("expected status %d; but got: %d", c.expectedStatus, rw.Code)
+			}
+			if actual := rw.Header().Get("Location"); actual != c.expectedLocation {
+				t.Errorf("expected location %q; but got: %q", c.expectedLocation, actual)
+			}
+			if c.expectedStatus == http.StatusUnauthorized {
+				if actual := rw.Body.String(); actual != `{"Error":"Login required"}` {
+					t.Errorf("expected JSON error; but got: %s", actual)
+				}
+			}
+		})
+	}
+}
+
+func Test_directServer_handlerLogout(t *testing.T) {
+	ds := newDirectTestServer(t)
+	c := loginDirect(t, ds)
+
+	rw := serveDirect(ds, http.MethodGet, wrapperPathPrefix+"logout", nil, c)
+
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != wrapperPathPrefix+"login" {
+		t.Errorf("expected redirect to the login page; but got: %d - %s", rw.Code, rw.Header().Get("Location"))
+	}
+	if removed := sessionCookieOf(rw); removed == nil || removed.MaxAge >= 0 {
+		t.Errorf("expected session cookie to be removed; but got: %v", removed)
+	}
+	if actual := len(ds.sessions); actual != 0 {
+		t.Errorf("expected session to be removed; but got: %d", actual)
+	}
+	if rw := serveDirect(ds, http.MethodGet, "/api/v1/serverstate", nil, c); rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected old session to be rejected; but got: %d", rw.Code)
+	}
+}
+
+func Test_directServer_handle_expiredSession(t *testing.T) {
+	ds := newDirectTestServer(t)
+	c := loginDirect(t, ds)
+	session := ds.sessions[c.Value]
+	session.expires = time.Now().Add(-time.Second)
+	ds.sessions[c.Value] = session
+
+	rw := serveDirect(ds, http.MethodGet, "/api/v1/serverstate", nil, c)
+
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected expired session to be rejected; but got: %d", rw.Code)
+	}
+	if _, ok := ds.sessions[c.Value]; ok {
+		t.Errorf("expected expired session to be removed")
+	}
+}
+
+func Test_sanitizeRedirect(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected string
+	}{
+		{"", "/prefix/"},
+		{"/prefix/ngax/index.html", "/prefix/ngax/index.html"},
+		{"/prefix/?job=1&view=log#x", "/prefix/?job=1&view=log#x"},
+		{"/prefix/a%2Fb", "/prefix/a%2Fb"},
+		{"prefix/", "/prefix/"},
+		{"//evil.com", "/prefix/"},
+		{"///evil.com", "/prefix/"},
+		{"/\\evil.com", "/prefix/"},
+		{"/\t/evil.com", "/prefix/"},
+		{"/\n/evil.com", "/prefix/"},
+		{"/\r/evil.com", "/prefix/"},
+		{"/ /evil.com", "/prefix/"},
+		{"/\u00a0/evil.com", "/prefix/"},
+		{"/\x00/evil.com", "/prefix/"},
+		{"/\u2028/evil.com", "/prefix/"},
+		{"/%2F/evil.com", "/prefix/"},
+		{"https://evil.com/", "/prefix/"},
+		{"https:/evil.com", "/prefix/"},
+		{"javascript:alert(1)", "/prefix/"},
+		{"/prefix/%zz", "/prefix/"},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			if actual := sanitizeRedirect(c.in, "/prefix"); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
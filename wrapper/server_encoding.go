@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+type contentEncoding string
+
+const (
+	contentEncodingIdentity contentEncoding = ""
+	contentEncodingGzip     contentEncoding = "gzip"
+	contentEncodingDeflate  contentEncoding = "deflate"
+	contentEncodingBrotli   contentEncoding = "br"
+)
+
+func contentEncodingOf(header string) (contentEncoding, bool) {
+	switch v := contentEncoding(strings.ToLower(strings.TrimSpace(header))); v {
+	case contentEncodingIdentity, "identity":
+		return contentEncodingIdentity, true
+	case "x-gzip":
+		return contentEncodingGzip, true
+	case contentEncodingGzip, contentEncodingDeflate, contentEncodingBrotli:
+		return v, true
+	default:
+		return v, false
+	}
+}
+
+func (ce contentEncoding) decode(b []byte) ([]byte, error) {
+	var r io.Reader
+	switch ce {
+	case contentEncodingIdentity:
+		return b, nil
+	case contentEncodingGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode gzip body: %w", err)
+		}
+		defer func() {
+			_ = gr.Close()
+		}()
+		r = gr
+	case contentEncodingDeflate:
+		// HTTP's deflate is zlib wrapped, but some servers send raw deflate.
+		zr, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			fr := flate.NewReader(bytes.NewReader(b))
+			defer func() {
+				_ = fr.Close()
+			}()
+			r = fr
+		} else {
+			defer func() {
+				_ = zr.Close()
+			}()
+			r = zr
+		}
+	case contentEncodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(b))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %q", ce)
+	}
+
+	result, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s body: %w", ce, err)
+	}
+	return result, nil
+}
+
+func (ce contentEncoding) encode(b []byte) ([]byte, error) {
+	if ce == contentEncodingIdentity {
+		return b, nil
+	}
+	var buf bytes.Buffer
+	w, err := ce.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, fmt.Errorf("cannot encode %s body: %w", ce, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot encode %s body: %w", ce, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (ce contentEncoding) writer(target io.Writer) (io.WriteCloser, error) {
+	switch ce {
+	case contentEncodingGzip:
+		return gzip.NewWriter(target), nil
+	case contentEncodingDeflate:
+		return zlib.NewWriter(target), nil
+	case contentEncodingBrotli:
+		return brotli.NewWriter(target), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %q", ce)
+	}
+}
+
+// filterAcceptEncoding removes every encoding from the given Accept-Encoding
+// header which could not be decoded again by interceptResponse.
+func filterAcceptEncoding(header string) string {
+	var result []string
+	for _, candidate := range strings.Split(header, ",") {
+		name, _, _ := strings.Cut(candidate, ";")
+		if _, ok := contentEncodingOf(name); ok && strings.TrimSpace(name) != "" {
+			result = append(result, strings.TrimSpace(candidate))
+		}
+	}
+	return strings.Join(result, ", ")
+}
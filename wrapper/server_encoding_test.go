@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testEncodingBody = []byte(strings.Repeat(`<script src="/api/v1/foo.js"></script>`, 20))
+
+func Test_contentEncodingOf(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected contentEncoding
+		ok       bool
+	}{
+		{"", contentEncodingIdentity, true},
+		{"identity", contentEncodingIdentity, true},
+		{"gzip", contentEncodingGzip, true},
+		{" GZIP ", contentEncodingGzip, true},
+		{"x-gzip", contentEncodingGzip, true},
+		{"deflate", contentEncodingDeflate, true},
+		{"br", contentEncodingBrotli, true},
+		{"zstd", "zstd", false},
+		{"gzip, br", "gzip, br", false},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			actual, ok := contentEncodingOf(c.header)
+			if actual != c.expected || ok != c.ok {
+				t.Errorf("expected %q (%v); but got: %q (%v)", c.expected, c.ok, actual, ok)
+			}
+		})
+	}
+}
+
+func Test_contentEncoding_roundTrip(t *testing.T) {
+	for _, ce := range []contentEncoding{contentEncodingIdentity, contentEncodingGzip, contentEncodingDeflate, contentEncodingBrotli} {
+		t.Run(string(ce), func(t *testing.T) {
+			encoded, err := ce.encode(testEncodingBody)
+			if err != nil {
+				t.Fatalf("cannot encode: %v", err)
+			}
+			if ce != contentEncodingIdentity && bytes.Equal(encoded, testEncodingBody) {
+				t.Errorf("expected body to be encoded")
+			}
+			decoded, err := ce.decode(encoded)
+			if err != nil {
+				t.Fatalf("cannot decode: %v", err)
+			}
+			if !bytes.Equal(decoded, testEncodingBody) {
+				t.Errorf("expected %q; but got: %q", testEncodingBody, decoded)
+			}
+		})
+	}
+}
+
+func Test_contentEncoding_decode_rawDeflate(t *testing.T) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fw.Write(testEncodingBody)
+	_ = fw.Close()
+
+	decoded, err := contentEncodingDeflate.decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("cannot decode: %v", err)
+	}
+	if !bytes.Equal(decoded, testEncodingBody) {
+		t.Errorf("expected %q; but got: %q", testEncodingBody, decoded)
+	}
+}
+
+func Test_contentEncoding_unsupported(t *testing.T) {
+	if _, err := contentEncoding("zstd").decode(testEncodingBody); err == nil {
+		t.Errorf("expected decode to fail")
+	}
+	if _, err := contentEncoding("zstd").encode(testEncodingBody); err == nil {
+		t.Errorf("expected encode to fail")
+	}
+}
+
+func Test_filterAcceptEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "gzip, deflate, br"},
+		{"gzip, deflate, br, zstd", "gzip, deflate, br"},
+		{"zstd;q=1.0, br;q=0.8, gzip;q=0.5", "br;q=0.8, gzip;q=0.5"},
+		{"x-gzip", "x-gzip"},
+		{"identity", "identity"},
+		{"*", ""},
+		{"zstd", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.header, func(t *testing.T) {
+			if actual := filterAcceptEncoding(c.header); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func testRewriteResponse(t *testing.T, header string, body []byte) *http.Response {
+	t.Helper()
+	rsp := &http.Response{
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	if header != "" {
+		rsp.Header.Set("Content-Encoding", header)
+	}
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return rsp
+}
+
+var testPrefixRule = rewriteRule{apply: func(b []byte, prefix string) []byte {
+	return bytes.ReplaceAll(b, []byte(`"/api/`), []byte(`"`+prefix+`/api/`))
+}}
+
+func Test_rewriteBody(t *testing.T) {
+	expected := bytes.ReplaceAll(testEncodingBody, []byte(`"/api/`), []byte(`"/prefix/api/`))
+	for _, header := range []string{"", "identity", "gzip", "x-gzip", "deflate", "br"} {
+		t.Run(header, func(t *testing.T) {
+			ce, _ := contentEncodingOf(header)
+			encoded, err := ce.encode(testEncodingBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsp := testRewriteResponse(t, header, encoded)
+
+			ok, err := rewriteBody(rsp, "/prefix", []rewriteRule{testPrefixRule})
+			if err != nil || !ok {
+				t.Fatalf("expected body to be rewritten; but got: %v (%v)", ok, err)
+			}
+
+			if actual := rsp.Header.Get("Content-Encoding"); actual != header {
+				t.Errorf("expected Content-Encoding %q; but got: %q", header, actual)
+			}
+			b, _ := io.ReadAll(rsp.Body)
+			if actual := rsp.Header.Get("Content-Length"); actual != strconv.Itoa(len(b)) {
+				t.Errorf("expected Content-Length %d; but got: %s", len(b), actual)
+			}
+			if rsp.ContentLength != int64(len(b)) {
+				t.Errorf("expected ContentLength %d; but got: %d", len(b), rsp.ContentLength)
+			}
+			decoded, err := ce.decode(b)
+			if err != nil {
+				t.Fatalf("cannot decode rewritten body: %v", err)
+			}
+			if !bytes.Equal(decoded, expected) {
+				t.Errorf("expected %q; but got: %q", expected, decoded)
+			}
+		})
+	}
+}
+
+func Test_rewriteBody_passesThroughUnsupported(t *testing.T) {
+	for _, header := range []string{"zstd", "gzip, br", "br, gzip"} {
+		t.Run(header, func(t *testing.T) {
+			rsp := testRewriteResponse(t, header, testEncodingBody)
+
+			ok, err := rewriteBody(rsp, "/prefix", []rewriteRule{testPrefixRule})
+			if err != nil || ok {
+				t.Fatalf("expected body to be left untouched; but got: %v (%v)", ok, err)
+			}
+
+			if actual := rsp.Header.Get("Content-Encoding"); actual != header {
+				t.Errorf("expected Content-Encoding %q; but got: %q", header, actual)
+			}
+			if actual := rsp.Header.Get("Content-Length"); actual != strconv.Itoa(len(testEncodingBody)) {
+				t.Errorf("expected Content-Length %d; but got: %s", len(testEncodingBody), actual)
+			}
+			b, _ := io.ReadAll(rsp.Body)
+			if !bytes.Equal(b, testEncodingBody) {
+				t.Errorf("expected body to be unchanged; but got: %q", b)
+			}
+		})
+	}
+}
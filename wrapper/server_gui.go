@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/echocat/slf4g"
+)
+
+const (
+	guiPreferencesFileDefault = "/data/gui.json"
+	guiPreferencesFileEnvVar  = "GUI_PREFERENCES_FILE"
+	guiCookie                 = "wrapper_gui"
+	guiCookieMaxAge           = 365 * 24 * time.Hour
+	guiQueryParameter         = "gui"
+)
+
+var (
+	guiBodyEndRegexp = regexp.MustCompile(`(?i)</body\s*>`)
+)
+
+func newGuiPreferences(logger log.Logger) (*guiPreferences, error) {
+	result := &guiPreferences{
+		fn:     guiPreferencesFileDefault,
+		values: map[string]optionsGui{},
+	}
+	if v := os.Getenv(guiPreferencesFileEnvVar); v != "" {
+		result.fn = v
+	}
+	f, err := os.Open(result.fn)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open gui preferences %q: %w", result.fn, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	logger = logger.With("file", result.fn)
+
+	// Broken or unknown preferences must not prevent the start; the affected
+	// users simply get the configured default again.
+	var values map[string]string
+	if err := json.NewDecoder(f).Decode(&values); err != nil {
+		logger.WithError(err).Warn("cannot decode gui preferences; ignoring them")
+		return result, nil
+	}
+	for user, v := range values {
+		gui, err := parseOptionsGui(v)
+		if err != nil || gui == "" {
+			logger.With("user", user).With("gui", v).Warn("ignoring unknown gui preference of user")
+			continue
+		}
+		result.values[user] = gui
+	}
+	return result, nil
+}
+
+// guiPreferences holds the GUI each Home Assistant user has chosen.
+type guiPreferences struct {
+	fn     string
+	mutex  sync.Mutex
+	values map[string]optionsGui
+}
+
+func (gp *guiPreferences) get(user string) (optionsGui, bool) {
+	gp.mutex.Lock()
+	defer gp.mutex.Unlock()
+	v, ok := gp.values[user]
+	return v, ok
+}
+
+func (gp *guiPreferences) set(user string, gui optionsGui) error {
+	gp.mutex.Lock()
+	defer gp.mutex.Unlock()
+	if v, ok := gp.values[user]; ok && v == gui {
+		return nil
+	}
+	gp.values[user] = gui
+
+	// Written to a temporary file which replaces the original one afterward,
+	// so a crash while writing never leaves a truncated file behind.
+	_ = os.MkdirAll(filepath.Dir(gp.fn), 0700)
+	f, err := os.CreateTemp(filepath.Dir(gp.fn), "."+filepath.Base(gp.fn)+".*")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary gui preferences for %q: %w", gp.fn, err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(gp.values); err != nil {
+		return fmt.Errorf("cannot write gui preferences %q: %w", f.Name(), err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("cannot sync gui preferences %q: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot close gui preferences %q: %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), gp.fn); err != nil {
+		return fmt.Errorf("cannot replace gui preferences %q: %w", gp.fn, err)
+	}
+	return nil
+}
+
+// guiUserOf returns the key the GUI preference of the user of the given
+// request is stored under. It is empty if the user is unknown.
+func guiUserOf(r *http.Request) string {
+	id, name := userOf(r)
+	if id != "" {
+		return id
+	}
+	if name != "" {
+		return "name:" + name
+	}
+	return ""
+}
+
+// guiOf resolves the GUI for the given request. A GUI explicitly requested
+// via query parameter is remembered for the user (and the browser); otherwise
+// the remembered one or the configured default is used.
+func (srv *server) guiOf(rw http.ResponseWriter, r *http.Request) (optionsGui, error) {
+	user := guiUserOf(r)
+	if v := r.URL.Query().Get(guiQueryParameter); v != "" {
+		gui, err := parseOptionsGui(v)
+		if err != nil {
+			return "", err
+		}
+		if user != "" {
+			if err := srv.guiPreferences.set(user, gui); err != nil {
+				srv.loggerOf(r).WithError(err).Warn("cannot remember gui of user")
+			}
+		}
+		http.SetCookie(rw, &http.Cookie{
+			Name:     guiCookie,
+			Value:    gui.String(),
+			Path:     prefixOf(r) + "/",
+			MaxAge:   int(guiCookieMaxAge.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return gui, nil
+	}
+
+	if user != "" {
+		if gui, ok := srv.guiPreferences.get(user); ok {
+			return gui, nil
+		}
+	}
+	if c, err := r.Cookie(guiCookie); err == nil {
+		if gui, err := parseOptionsGui(c.Value); err == nil && gui != "" {
+			return gui, nil
+		}
+	}
+	return srv.options.gui, nil
+}
+
+// injectGuiSwitcher adds a small link to the other GUI to the end of a full
+// HTML document. Fragments (like the templates of ngax) are left untouched.
+func injectGuiSwitcher(b []byte, prefix string, gui optionsGui) []byte {
+	locs := guiBodyEndRegexp.FindAllIndex(b, -1)
+	if len(locs) == 0 {
+		return b
+	}
+	other, title := guiNgclient, "Switch to the new user interface (ngclient)"
+	if gui == guiNgclient {
+		other, title = guiNgax, "Switch to the classic user interface (ngax)"
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<a href="`)
+	buf.WriteString(html.EscapeString(prefix + "/?" + guiQueryParameter + "=" + other.String()))
+	buf.WriteString(`" title="`)
+	buf.WriteString(title)
+	buf.WriteString(`" style="position:fixed;right:.5em;bottom:.5em;z-index:2147483647;padding:.2em .6em;`)
+	buf.WriteString(`font:12px sans-serif;color:#fff;background:rgba(0,0,0,.45);border-radius:.3em;text-decoration:none">`)
+	buf.WriteString(other.String())
+	buf.WriteString(`</a>`)
+	return insertAt(b, locs[len(locs)-1][0], buf.Bytes())
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+func newGuiTestServer(t *testing.T) *server {
+	t.Helper()
+	t.Setenv(guiPreferencesFileEnvVar, filepath.Join(t.TempDir(), "gui.json"))
+	srv := &server{
+		options: options{gui: guiNgclient},
+		logger:  log.GetLogger("test"),
+		state:   newState(),
+	}
+	var err error
+	if srv.guiPreferences, err = newGuiPreferences(srv.logger); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func Test_server_guiOf(t *testing.T) {
+	cases := []struct {
+		name          string
+		saved         optionsGui
+		cookie        string
+		query         string
+		userId        string
+		expected      optionsGui
+		expectedSaved optionsGui
+	}{
+		{name: "default", expected: guiNgclient},
+		{name: "defaultForUser", userId: "u1", expected: guiNgclient},
+		{name: "cookieBeatsDefault", cookie: "ngax", expected: guiNgax},
+		{name: "cookieBeatsDefaultForUser", userId: "u1", cookie: "ngax", expected: guiNgax},
+		{name: "unknownCookie", cookie: "legacy", expected: guiNgclient},
+		{name: "savedBeatsCookie", userId: "u1", saved: guiNgclient, cookie: "ngax", expected: guiNgclient, expectedSaved: guiNgclient},
+		{name: "savedBeatsDefault", userId: "u1", saved: guiNgax, expected: guiNgax, expectedSaved: guiNgax},
+		{name: "queryBeatsSaved", userId: "u1", saved: guiNgax, cookie: "ngax", query: "ngclient", expected: guiNgclient, expectedSaved: guiNgclient},
+		{name: "queryIsSaved", userId: "u1", query: "NGAX", expected: guiNgax, expectedSaved: guiNgax},
+		{name: "queryWithoutUser", query: "ngax", expected: guiNgax},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newGuiTestServer(t)
+			if c.saved != "" {
+				if err := srv.guiPreferences.set(c.userId, c.saved); err != nil {
+					t.Fatal(err)
+				}
+			}
+			target := "http://localhost/"
+			if c.query != "" {
+				target += "?" + guiQueryParameter + "=" + c.query
+			}
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if c.userId != "" {
+				r.Header.Set("X-Remote-User-Id", c.userId)
+			}
+			if c.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: guiCookie, Value: c.cookie})
+			}
+			rw := httptest.NewRecorder()
+
+			actual, err := srv.guiOf(rw, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != c.expected {
+				t.Errorf("expected %v; but got: %v", c.expected, actual)
+			}
+			if saved, _ := srv.guiPreferences.get(c.userId); saved != c.expectedSaved {
+				t.Errorf("expected saved gui %q; but got: %q", c.expectedSaved, saved)
+			}
+			var cookie *http.Cookie
+			for _, candidate := range rw.Result().Cookies() {
+				if candidate.Name == guiCookie {
+					cookie = candidate
+				}
+			}
+			if c.query == "" && cookie != nil {
+				t.Errorf("expected no cookie without query; but got: %v", cookie)
+			} else if c.query != "" && (cookie == nil || cookie.Value != c.expected.String() || !cookie.HttpOnly) {
+				t.Errorf("expected cookie with %v; but got: %v", c.expected, cookie)
+			}
+		})
+	}
+}
+
+func Test_server_handlerIndex_unknownGui(t *testing.T) {
+	srv := newGuiTestServer(t)
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/?"+guiQueryParameter+"=legacy", nil)
+	r.Header.Set("X-Remote-User-Id", "u1")
+	rw := httptest.NewRecorder()
+
+	srv.handlerIndex(rw, r)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400; but got: %d", rw.Code)
+	}
+	if _, ok := srv.guiPreferences.get("u1"); ok {
+		t.Errorf("expected unknown gui not to be saved")
+	}
+	if actual := rw.Header().Values("Set-Cookie"); len(actual) != 0 {
+		t.Errorf("expected no cookie; but got: %v", actual)
+	}
+}
+
+func Test_injectGuiSwitcher(t *testing.T) {
+	cases := []struct {
+		name     string
+		in       string
+		gui      optionsGui
+		expected string
+	}{
+		{"ngclient", `<html><body><app-root></app-root></body></html>`, guiNgclient, `<html><body><app-root></app-root>{switcher}</body></html>`},
+		{"ngax", `<html><BODY><div></div></BODY ></html>`, guiNgax, `<html><BODY><div></div>{switcher}</BODY ></html>`},
+		{"beforeLastBody", `<body><script>var s="</body>";</script></body>`, guiNgclient, `<body><script>var s="</body>";</script>{switcher}</body>`},
+		{"fragment", `<div class="state"><a href="#/log">log</a></div>`, guiNgax, `<div class="state"><a href="#/log">log</a></div>`},
+		{"empty", ``, guiNgax, ``},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			other := guiNgclient
+			if c.gui == guiNgclient {
+				other = guiNgax
+			}
+			switcher := strings.TrimSuffix(string(injectGuiSwitcher([]byte("</body>"), "/prefix", c.gui)), "</body>")
+			if !strings.Contains(switcher, `href="/prefix/?gui=`+other.String()+`"`) {
+				t.Errorf("expected link to %v; but got: %s", other, switcher)
+			}
+			expected := strings.Replace(c.expected, "{switcher}", switcher, 1)
+
+			if actual := string(injectGuiSwitcher([]byte(c.in), "/prefix", c.gui)); actual != expected {
+				t.Errorf("expected:\n%s\nbut got:\n%s", expected, actual)
+			}
+		})
+	}
+}
+
+func Test_guiPreferences_survivesReload(t *testing.T) {
+	srv := newGuiTestServer(t)
+	if err := srv.guiPreferences.set("u1", guiNgax); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.guiPreferences.set("name:someone", guiNgclient); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := newGuiPreferences(log.GetLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for user, expected := range map[string]optionsGui{"u1": guiNgax, "name:someone": guiNgclient} {
+		if actual, _ := reloaded.get(user); actual != expected {
+			t.Errorf("expected %v for %s; but got: %v", expected, user, actual)
+		}
+	}
+	// Nothing is left behind by the atomic write.
+	entries, err := os.ReadDir(filepath.Dir(reloaded.fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the preferences file; but got: %v", entries)
+	}
+}
+
+func Test_newGuiPreferences_ignoresUnknownValues(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		expected map[string]optionsGui
+	}{
+		{"unknownValues", `{"u1":"ngax","u2":"legacy","u3":"","u4":"NGCLIENT"}`, map[string]optionsGui{"u1": guiNgax, "u4": guiNgclient}},
+		{"broken", `{"u1":`, map[string]optionsGui{}},
+		{"wrongType", `["ngax"]`, map[string]optionsGui{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fn := filepath.Join(t.TempDir(), "gui.json")
+			if err := os.WriteFile(fn, []byte(c.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(guiPreferencesFileEnvVar, fn)
+
+			actual, err := newGuiPreferences(log.GetLogger("test"))
+			if err != nil {
+				t.Fatalf("expected broken preferences not to prevent the start; but got: %v", err)
+			}
+			if len(actual.values) != len(c.expected) {
+				t.Errorf("expected %v; but got: %v", c.expected, actual.values)
+			}
+			for user, expected := range c.expected {
+				if v, _ := actual.get(user); v != expected {
+					t.Errorf("expected %v for %s; but got: %v", expected, user, v)
+				}
+			}
+		})
+	}
+}
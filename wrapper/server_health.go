@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+const (
+	wrapperPathPrefix    = "/_wrapper/"
+	upstreamCheckTimeout = 2 * time.Second
+)
+
+type healthPayload struct {
+	Status   string           `json:"status"`
+	Process  *stateSnapshot   `json:"process,omitempty"`
+	Upstream *upstreamPayload `json:"upstream,omitempty"`
+}
+
+type upstreamPayload struct {
+	Reachable bool   `json:"reachable"`
+	Error     string `json:"error,omitempty"`
+}
+
+// isPublicWrapperPath reports whether the path is one of the wrapper's own
+// endpoints which can be requested without any authorization.
+func isPublicWrapperPath(path string) bool {
+	switch path {
+	case wrapperPathPrefix + "health", wrapperPathPrefix + "ready":
+		return true
+	default:
+		return false
+	}
+}
+
+func (srv *server) handlerHealth(rw http.ResponseWriter, r *http.Request) {
+	srv.serveHealth(rw, r, false)
+}
+
+func (srv *server) handlerReady(rw http.ResponseWriter, r *http.Request) {
+	srv.serveHealth(rw, r, true)
+}
+
+func (srv *server) serveHealth(rw http.ResponseWriter, r *http.Request, requireUpstream bool) {
+	switch r.Method {
+	case "GET", "HEAD":
+	default:
+		http.Error(rw, "Bad Request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	process := srv.state.snapshot()
+	var upstream upstreamPayload
+	if err := srv.checkUpstream(r.Context()); err != nil {
+		upstream.Error = err.Error()
+	} else {
+		upstream.Reachable = true
+	}
+
+	var payload healthPayload
+	if srv.mayReadHealthDetails(r) {
+		payload.Process, payload.Upstream = &process, &upstream
+	}
+
+	// The health endpoint only fails if the process is gone, to prevent the
+	// watchdog from restarting us while a slow boot or download is running.
+	status := http.StatusOK
+	switch process.Phase {
+	case processPhaseRunning:
+		if upstream.Reachable {
+			payload.Status = "ok"
+		} else {
+			payload.Status = "starting"
+			if requireUpstream {
+				status = http.StatusServiceUnavailable
+			}
+		}
+	case processPhaseStarting:
+		payload.Status = "starting"
+		if requireUpstream {
+			status = http.StatusServiceUnavailable
+		}
+	default:
+		payload.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(payload)
+}
+
+// mayReadHealthDetails reports whether the caller may see more than the status
+// (like the pid, the release or the last error): only the Supervisor, the
+// ingress and admins which logged in directly.
+func (srv *server) mayReadHealthDetails(r *http.Request) bool {
+	if isDirectSession(r) {
+		return srv.roleOf(r).permits(roleAdmin)
+	}
+	return srv.isIngressSource(r)
+}
+
+func (srv *server) checkUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, upstreamCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.upstreamUrl.String()+"/", nil)
+	if err != nil {
+		return fmt.Errorf("cannot create request to upstream: %w", err)
+	}
+	rsp, err := srv.upstreamClient.Do(req)
+	if err != nil {
+		srv.setUpstreamReady(false)
+		return fmt.Errorf("upstream not reachable: %w", err)
+	}
+	_ = rsp.Body.Close()
+	srv.setUpstreamReady(true)
+	return nil
+}
+
+func (srv *server) setUpstreamReady(v bool) {
+	srv.upstreamReady.Store(v)
+	if v {
+		srv.upstreamWasReady.Store(true)
+	}
+}
+
+func (srv *server) isReady(ctx context.Context) bool {
+	if srv.state.getPhase() != processPhaseRunning {
+		return false
+	}
+	if srv.upstreamReady.Load() {
+		return true
+	}
+	return srv.checkUpstream(ctx) == nil
+}
+
+var (
+	//go:embed server_starting.html
+	startingPageHtml string
+
+	startingPageTemplate = template.Must(template.New("starting").Parse(startingPageHtml))
+)
+
+func (srv *server) serveStartingPage(rw http.ResponseWriter, r *http.Request) {
+	if srv.unavailableReasonOf(nil) == unavailableReasonCrashed {
+		srv.serveUnavailable(rw, r, nil)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := startingPageTemplate.Execute(rw, srv.state.snapshot()); err != nil {
+		srv.loggerOf(r).WithError(err).Warn("cannot render starting page")
+	}
+}
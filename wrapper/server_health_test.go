@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+func Test_server_serveHealth_details(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer upstream.Close()
+
+	st := newState()
+	st.setRelease("custom-release")
+	st.setRunning(4711)
+	st.recordError(errors.New("something failed"))
+	srv := &server{
+		options: options{
+			defaultRole: roleAdmin,
+			accessControl: []optionsAccessControlEntry{
+				{User: "admin", Role: roleAdmin},
+			},
+		},
+		logger:         log.GetLogger("test"),
+		state:          st,
+		ingressSources: []netip.Prefix{netip.MustParsePrefix("172.30.32.2/32")},
+	}
+	var err error
+	if srv.upstreamUrl, err = url.Parse(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name            string
+		remote          string
+		directUser      string
+		expectedDetails bool
+	}{
+		{"ingress", "172.30.32.2:40000", "", true},
+		{"loopback", "127.0.0.1:40000", "", true},
+		{"other", "192.168.1.20:40000", "", false},
+		{"directAdmin", "192.168.1.20:40000", "admin", true},
+		{"directViewer", "192.168.1.20:40000", "someone", false},
+		// Even from an ingress source, the role of direct sessions counts.
+		{"directViewerViaIngressSource", "172.30.32.2:40000", "someone", false},
+	}
+	for _, c := range cases {
+		for _, path := range []string{wrapperPathPrefix + "health", wrapperPathPrefix + "ready"} {
+			t.Run(c.name+" "+path, func(t *testing.T) {
+				r := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+				r.RemoteAddr = c.remote
+				if c.directUser != "" {
+					r.Header.Set("X-Remote-User-Name", c.directUser)
+					r = r.WithContext(withDirectSession(r.Context()))
+				}
+				rw := httptest.NewRecorder()
+
+				srv.handle(rw, r)
+
+				if rw.Code != http.StatusOK {
+					t.Errorf("expected status 200; but got: %d", rw.Code)
+				}
+				var payload map[string]any
+				if err := json.NewDecoder(rw.Body).Decode(&payload); err != nil {
+					t.Fatal(err)
+				}
+				if payload["status"] != "ok" {
+					t.Errorf("expected status ok; but got: %v", payload["status"])
+				}
+				_, hasProcess := payload["process"]
+				_, hasUpstream := payload["upstream"]
+				if hasProcess != c.expectedDetails || hasUpstream != c.expectedDetails {
+					t.Errorf("expected details to be present: %v; but got: %v", c.expectedDetails, payload)
+				}
+			})
+		}
+	}
+}
+
+func Test_server_serveHealth_statusWithoutDetails(t *testing.T) {
+	st := newState()
+	st.setRunning(4711)
+	st.setExited(1, nil)
+	srv := &server{
+		logger: log.GetLogger("test"),
+		state:  st,
+	}
+	var err error
+	if srv.upstreamUrl, err = url.Parse("http://127.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://localhost"+wrapperPathPrefix+"health", nil)
+	r.RemoteAddr = "192.168.1.20:40000"
+	rw := httptest.NewRecorder()
+
+	srv.handle(rw, r)
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503; but got: %d", rw.Code)
+	}
+	if actual := rw.Body.String(); actual != "{\n  \"status\": \"unavailable\"\n}\n" {
+		t.Errorf("expected only the status; but got: %s", actual)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	httpReadHeaderTimeoutDefault = 10 * time.Second
+	httpIdleTimeoutDefault       = 2 * time.Minute
+	httpMaxHeaderSizeDefault     = 64 * 1024
+	httpMaxConnectionsDefault    = 256
+	authRateLimitDefault         = 30
+
+	// httpConnectionsReserve is the number of connections above the limit
+	// which are still accepted, but only for the health endpoints.
+	httpConnectionsReserve = 16
+
+	rateLimiterCleanupInterval = time.Minute
+)
+
+// configureHttpServer applies the limits of the options to the given server.
+// Read and write timeouts are disabled by default, because these would
+// interrupt websockets, large uploads and downloads (like restores).
+func configureHttpServer(impl *http.Server, opt options) {
+	impl.ReadHeaderTimeout = opt.httpReadHeaderTimeout
+	impl.ReadTimeout = opt.httpReadTimeout
+	impl.WriteTimeout = opt.httpWriteTimeout
+	impl.IdleTimeout = opt.httpIdleTimeout
+	impl.MaxHeaderBytes = opt.httpMaxHeaderSize
+	impl.ConnContext = connContextOf
+}
+
+// clearDeadlines removes the read and write timeouts of the connection of the
+// given request, which are required for long living connections (like
+// websockets).
+func clearDeadlines(rw http.ResponseWriter) {
+	rc := http.NewResponseController(rw)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+}
+
+func limitListener(l net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return l
+	}
+	return &connectionLimitListener{
+		Listener: l,
+		limit:    int64(n),
+		reserve:  httpConnectionsReserve,
+	}
+}
+
+// connectionLimitListener counts the open connections. The first reserve
+// connections above the limit are still accepted, but are only allowed to
+// request the health endpoints (see checkConnectionLimit); otherwise a few open
+// tabs with their websockets could starve the watchdog of the Supervisor.
+// Every further connection is closed right away.
+type connectionLimitListener struct {
+	net.Listener
+	limit   int64
+	reserve int64
+	active  atomic.Int64
+}
+
+func (l *connectionLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		active := l.active.Add(1)
+		if active > l.limit+l.reserve {
+			l.active.Add(-1)
+			_ = c.Close()
+			continue
+		}
+		return &connectionLimitConn{
+			Conn:     c,
+			exceeded: active > l.limit,
+			release:  sync.OnceFunc(func() { l.active.Add(-1) }),
+		}, nil
+	}
+}
+
+type connectionLimitConn struct {
+	net.Conn
+	exceeded bool
+	release  func()
+}
+
+func (c *connectionLimitConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+type connectionLimitExceededKey struct{}
+
+// connContextOf marks the context of connections above the limit; it is
+// used as http.Server.ConnContext.
+func connContextOf(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if lc, ok := c.(*connectionLimitConn); ok && lc.exceeded {
+		return context.WithValue(ctx, connectionLimitExceededKey{}, true)
+	}
+	return ctx
+}
+
+// checkConnectionLimit answers the request itself with 503 (and closes the
+// connection) if it came in on a connection above the limit and is not for
+// one of the health endpoints.
+func (srv *server) checkConnectionLimit(rw http.ResponseWriter, r *http.Request) bool {
+	if exceeded, _ := r.Context().Value(connectionLimitExceededKey{}).(bool); !exceeded || isPublicWrapperPath(r.URL.Path) {
+		return true
+	}
+
+	srv.loggerOf(r).With("uri", r.URL.Path).
+		With("remote", r.RemoteAddr).
+		Warn("rejected request on connection which exceeded the connection limit")
+	rw.Header().Set("Connection", "close")
+	rw.Header().Set("Retry-After", "1")
+	if wantsJson(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprint(rw, `{"Error":"Too many connections"}`)
+		return false
+	}
+	http.Error(rw, "Too many connections", http.StatusServiceUnavailable)
+	return false
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: map[string]*rateBucket{},
+	}
+}
+
+// rateLimiter is a token bucket per client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex       sync.Mutex
+	buckets     map[string]*rateBucket
+	lastCleanup time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow consumes one token of the given client. If there is none left, it
+// returns how long the client has to wait for the next one.
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if now.Sub(rl.lastCleanup) > rateLimiterCleanupInterval {
+		for k, b := range rl.buckets {
+			if b.tokensAt(now, rl) >= rl.burst {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastCleanup = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &rateBucket{tokens: rl.burst, updated: now}
+		rl.buckets[key] = b
+	}
+	b.tokens, b.updated = b.tokensAt(now, rl), now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *rateBucket) tokensAt(now time.Time, rl *rateLimiter) float64 {
+	return math.Min(rl.burst, b.tokens+now.Sub(b.updated).Seconds()*rl.rate)
+}
+
+// isRateLimitedPath checks the path the way Duplicati routes it (see
+// accessPathOf); otherwise /API/v1/auth/... would bypass the limit.
+func isRateLimitedPath(r *http.Request) bool {
+	p := accessPathOf(r)
+	return p == wrapperPathPrefix+"login" || strings.HasPrefix(p+"/", "/api/v1/auth/")
+}
+
+// rateLimitKeyOf identifies the client of the request. Behind the ingress all
+// requests come from the same address; so the Home Assistant user is used.
+// Behind a trusted proxy the address of the client added by the proxy is used
+// (see clientAddrOf), which cannot be chosen by the client itself.
+func (srv *server) rateLimitKeyOf(r *http.Request) string {
+	if srv.isIngressSource(r) {
+		if id, name := userOf(r); id != "" || name != "" {
+			return "user:" + id + ":" + name
+		}
+	}
+	if srv.isTrustedProxy(r) {
+		return "addr:" + srv.clientAddrOf(r)
+	}
+	if addr, ok := remoteAddrOf(r); ok {
+		return "addr:" + addr.String()
+	}
+	return "remote:" + r.RemoteAddr
+}
+
+// checkRateLimit answers the request itself with 429 if the client exceeded
+// the rate limit of the authentication endpoints.
+func (srv *server) checkRateLimit(rw http.ResponseWriter, r *http.Request) bool {
+	if srv.authLimiter == nil || !isRateLimitedPath(r) {
+		return true
+	}
+	key := srv.rateLimitKeyOf(r)
+	ok, wait := srv.authLimiter.allow(key)
+	if ok {
+		return true
+	}
+
+	srv.loggerOf(r).With("uri", r.URL.Path).
+		With("remote", r.RemoteAddr).
+		With("client", key).
+		Warn("rejected request which exceeded the rate limit")
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if wantsJson(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusTooManyRequests)
+		_, _ = fmt.Fprint(rw, `{"Error":"Too many requests"}`)
+		return false
+	}
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	log "github.com/echocat/slf4g"
+)
+
+func Test_isRateLimitedPath(t *testing.T) {
+	cases := []struct {
+		path     string
+		expected bool
+	}{
+		{"/_wrapper/login", true},
+		{"/api/v1/auth/login", true},
+		{"/api/v1/auth/refresh", true},
+		{"/api/v1/auth", true},
+		{"/api/v1/backups", false},
+		{"/api/v1/authx", false},
+		{"/ngax/index.html", false},
+
+		{"/API/v1/auth/login", true},
+		{"/Api/V1/Auth/Signin", true},
+		{"//api/v1/auth/login", true},
+		{"/api//v1/auth/login", true},
+		{"/api/v1/x/../auth/login", true},
+		{"/_WRAPPER/login", true},
+		{"//_wrapper/login", true},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://localhost/", nil)
+			r.URL.Path = c.path
+			if actual := isRateLimitedPath(r); actual != c.expected {
+				t.Errorf("expected %v; but got: %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_connectionLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &connectionLimitListener{Listener: inner, limit: 2, reserve: 1}
+	defer func() {
+		_ = l.Close()
+	}()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	var clients []net.Conn
+	defer func() {
+		for _, c := range clients {
+			_ = c.Close()
+		}
+	}()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+		return c
+	}
+	next := func() *connectionLimitConn {
+		select {
+		case c := <-accepted:
+			return c.(*connectionLimitConn)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected connection to be accepted")
+			return nil
+		}
+	}
+
+	var conns []*connectionLimitConn
+	for i := 0; i < 3; i++ {
+		dial()
+		conns = append(conns, next())
+	}
+	if conns[0].exceeded || conns[1].exceeded {
+		t.Errorf("expected connections within the limit not to be marked")
+	}
+	if !conns[2].exceeded {
+		t.Errorf("expected connection of the reserve to be marked")
+	}
+
+	// Beyond the reserve connections are closed without being handed out.
+	rejected := dial()
+	_ = rejected.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected connection beyond the reserve to be closed; but got: %v", err)
+	}
+	select {
+	case <-accepted:
+		t.Errorf("expected connection beyond the reserve not to be accepted")
+	default:
+	}
+
+	// Closed connections free their slot again (even if closed twice).
+	_ = conns[0].Close()
+	_ = conns[0].Close()
+	_ = conns[2].Close()
+	dial()
+	if c := next(); c.exceeded {
+		t.Errorf("expected connection to be within the limit again")
+	}
+	dial()
+	if c := next(); !c.exceeded {
+		t.Errorf("expected connection of the reserve to be marked")
+	}
+	if actual := l.active.Load(); actual != 3 {
+		t.Errorf("expected 3 active connections; but got: %d", actual)
+	}
+}
+
+func Test_rateLimiter_allow(t *testing.T) {
+	rl := newRateLimiter(6)
+
+	for i := 0; i < 6; i++ {
+		if ok, wait := rl.allow("a"); !ok || wait != 0 {
+			t.Fatalf("expected request %d within the burst to be allowed; but got: %v, %v", i, ok, wait)
+		}
+	}
+	ok, wait := rl.allow("a")
+	if ok {
+		t.Fatalf("expected request above the burst to be refused")
+	}
+	// 6 per minute is one every 10 seconds.
+	if wait <= 0 || wait > 10*time.Second {
+		t.Errorf("expected to wait up to 10s; but got: %v", wait)
+	}
+
+	// Other clients have their own bucket.
+	if ok, _ := rl.allow("b"); !ok {
+		t.Errorf("expected other client to be allowed")
+	}
+
+	// After waiting, there is a token again - but only one.
+	rl.buckets["a"].updated = rl.buckets["a"].updated.Add(-wait)
+	if ok, _ := rl.allow("a"); !ok {
+		t.Errorf("expected request after waiting to be allowed")
+	}
+	if ok, _ := rl.allow("a"); ok {
+		t.Errorf("expected next request to be refused again")
+	}
+}
+
+func Test_rateLimiter_allow_cleanup(t *testing.T) {
+	rl := newRateLimiter(6)
+	rl.allow("full")
+	rl.allow("partial")
+	now := time.Now()
+	rl.buckets["full"].updated = now.Add(-time.Minute)
+	rl.buckets["partial"].tokens = 0
+	rl.buckets["partial"].updated = now
+	rl.lastCleanup = now.Add(-2 * rateLimiterCleanupInterval)
+
+	rl.allow("other")
+
+	if _, ok := rl.buckets["full"]; ok {
+		t.Errorf("expected full bucket to be dropped")
+	}
+	if _, ok := rl.buckets["partial"]; !ok {
+		t.Errorf("expected partial bucket to be kept")
+	}
+	if _, ok := rl.buckets["other"]; !ok {
+		t.Errorf("expected bucket of the current client to be kept")
+	}
+}
+
+func Test_newRateLimiter_disabled(t *testing.T) {
+	if rl := newRateLimiter(0); rl != nil {
+		t.Errorf("expected no rate limiter; but got: %v", rl)
+	}
+}
+
+func Test_server_checkRateLimit(t *testing.T) {
+	srv := &server{
+		logger:      log.GetLogger("test"),
+		authLimiter: newRateLimiter(2),
+	}
+	request := func(method, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://localhost"+path, nil)
+		r.RemoteAddr = "192.168.1.20:40000"
+		rw := httptest.NewRecorder()
+		if srv.checkRateLimit(rw, r) {
+			rw.WriteHeader(http.StatusOK)
+		}
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := request(http.MethodPost, "/api/v1/auth/signin"); rw.Code != http.StatusOK {
+			t.Fatalf("expected request %d to pass; but got: %d", i, rw.Code)
+		}
+	}
+
+	rw := request(http.MethodPost, "/api/v1/auth/signin")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429; but got: %d", rw.Code)
+	}
+	if v, err := strconv.Atoi(rw.Header().Get("Retry-After")); err != nil || v <= 0 {
+		t.Errorf("expected positive Retry-After; but got: %q", rw.Header().Get("Retry-After"))
+	}
+	if actual := rw.Body.String(); actual != `{"Error":"Too many requests"}` {
+		t.Errorf("expected JSON error; but got: %s", actual)
+	}
+
+	for _, path := range []string{"/API/v1/auth/signin", wrapperPathPrefix + "login"} {
+		if rw := request(http.MethodPost, path); rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+			t.Errorf("expected %s to share the limit; but got: %d", path, rw.Code)
+		}
+	}
+	if rw := request(http.MethodGet, "/api/v1/backups"); rw.Code != http.StatusOK {
+		t.Errorf("expected other paths not to be limited; but got: %d", rw.Code)
+	}
+}
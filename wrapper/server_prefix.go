@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type prefixContextKey struct{}
+
+// newPrefixResolver creates a resolver which takes the prefix of ingress
+// requests always from X-Ingress-Path. prefix_source only configures how the
+// prefix of requests forwarded by trusted proxies is resolved.
+func newPrefixResolver(opt options) (result prefixResolver, err error) {
+	result.source = optionsPrefixSource(opt.prefixSource.String())
+	if result.fixed, err = sanitizePrefix(opt.prefix); err != nil {
+		return prefixResolver{}, fmt.Errorf("illegal prefix: %w", err)
+	}
+	if result.source == prefixSourceFixed && result.fixed == "" {
+		return prefixResolver{}, fmt.Errorf("prefix_source is %v but no prefix was configured", result.source)
+	}
+	// X-Ingress-Path is set by the Supervisor's ingress gateway.
+	if result.ingress, err = parseAddressPrefixes(opt.ingressSources); err != nil {
+		return prefixResolver{}, fmt.Errorf("illegal ingress_sources: %w", err)
+	}
+	if result.proxies, err = parseAddressPrefixes(opt.trustedProxies); err != nil {
+		return prefixResolver{}, fmt.Errorf("illegal trusted_proxies: %w", err)
+	}
+	if result.source != prefixSourceIngress && len(result.proxies) == 0 {
+		return prefixResolver{}, fmt.Errorf("prefix_source is %v but no trusted_proxies were configured", result.source)
+	}
+	return result, nil
+}
+
+type prefixResolver struct {
+	source  optionsPrefixSource
+	fixed   string
+	ingress []netip.Prefix
+	proxies []netip.Prefix
+}
+
+// resolve returns the prefix of the given request depending on where it
+// comes from: X-Ingress-Path for ingress sources, X-Forwarded-Prefix or the
+// fixed prefix for trusted proxies and nothing for everybody else; otherwise
+// every client could inject its own prefix.
+func (pr prefixResolver) resolve(r *http.Request) string {
+	addr, ok := remoteAddrOf(r)
+	if !ok {
+		return ""
+	}
+	if addr.IsLoopback() || containsAddr(pr.ingress, addr) {
+		if v := prefixOfHeader(r, "X-Ingress-Path"); v != "" {
+			return v
+		}
+	}
+	if !containsAddr(pr.proxies, addr) {
+		return ""
+	}
+	switch pr.source {
+	case prefixSourceFixed:
+		return pr.fixed
+	case prefixSourceForwarded:
+		return prefixOfHeader(r, "X-Forwarded-Prefix")
+	default:
+		return ""
+	}
+}
+
+func prefixOfHeader(r *http.Request, header string) string {
+	// Proxies chaining X-Forwarded-Prefix might append values.
+	v, _, _ := strings.Cut(r.Header.Get(header), ",")
+	result, err := sanitizePrefix(v)
+	if err != nil {
+		return ""
+	}
+	return result
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, candidate := range prefixes {
+		if candidate.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func withPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, prefixContextKey{}, prefix)
+}
+
+// prefixOf returns the path prefix resolved for the given request (or the
+// outgoing request derived from it) by server.handleWrapper.
+func prefixOf(r *http.Request) string {
+	v, _ := r.Context().Value(prefixContextKey{}).(string)
+	return v
+}
+
+func sanitizePrefix(in string) (string, error) {
+	in = strings.TrimSpace(in)
+	in = strings.TrimRight(in, "/")
+	if in == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(in, "/") || strings.HasPrefix(in, "//") {
+		return "", fmt.Errorf("prefix %q has to start with exactly one /", in)
+	}
+	for _, c := range in {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("/-._~%", c):
+		default:
+			return "", fmt.Errorf("prefix %q contains illegal character %q", in, c)
+		}
+	}
+	return in, nil
+}
+
+func remoteAddrOf(r *http.Request) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if a, err := netip.ParseAddr(r.RemoteAddr); err == nil {
+		return a.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+func parseAddressPrefixes(in []string) ([]netip.Prefix, error) {
+	result := make([]netip.Prefix, 0, len(in))
+	for _, v := range in {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if p, err := netip.ParsePrefix(v); err == nil {
+			result = append(result, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an IP address nor a CIDR", v)
+		}
+		a = a.Unmap()
+		result = append(result, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return result, nil
+}
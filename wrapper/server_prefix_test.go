@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_prefixResolver_resolve(t *testing.T) {
+	base := options{
+		ingressSources: []string{"172.30.32.2"},
+		trustedProxies: []string{"192.0.2.10"},
+		prefix:         "/fixed",
+	}
+	cases := []struct {
+		name     string
+		source   optionsPrefixSource
+		remote   string
+		header   string
+		value    string
+		expected string
+	}{
+		{"ingress", prefixSourceIngress, "172.30.32.2", "X-Ingress-Path", "/api/hassio_ingress/abc", "/api/hassio_ingress/abc"},
+		{"ingress from loopback", prefixSourceIngress, "127.0.0.1", "X-Ingress-Path", "/api/hassio_ingress/abc", "/api/hassio_ingress/abc"},
+		{"ingress with forwarded", prefixSourceForwarded, "172.30.32.2", "X-Ingress-Path", "/api/hassio_ingress/abc", "/api/hassio_ingress/abc"},
+		{"ingress with fixed", prefixSourceFixed, "172.30.32.2", "X-Ingress-Path", "/api/hassio_ingress/abc", "/api/hassio_ingress/abc"},
+		{"ingress without header and fixed", prefixSourceFixed, "172.30.32.2", "", "", ""},
+		{"ingress ignores forwarded prefix", prefixSourceForwarded, "172.30.32.2", "X-Forwarded-Prefix", "/evil", ""},
+		{"proxy with forwarded", prefixSourceForwarded, "192.0.2.10", "X-Forwarded-Prefix", "/duplicati", "/duplicati"},
+		{"proxy with chained forwarded", prefixSourceForwarded, "192.0.2.10", "X-Forwarded-Prefix", "/duplicati,/other", "/duplicati"},
+		{"proxy with fixed", prefixSourceFixed, "192.0.2.10", "X-Forwarded-Prefix", "/duplicati", "/fixed"},
+		{"proxy with ingress", prefixSourceIngress, "192.0.2.10", "X-Forwarded-Prefix", "/duplicati", ""},
+		{"proxy ignores ingress path", prefixSourceForwarded, "192.0.2.10", "X-Ingress-Path", "/api/hassio_ingress/abc", ""},
+		{"proxy with illegal prefix", prefixSourceForwarded, "192.0.2.10", "X-Forwarded-Prefix", "//evil.com", ""},
+		{"other with ingress path", prefixSourceIngress, "192.0.2.99", "X-Ingress-Path", "/evil", ""},
+		{"other with forwarded", prefixSourceForwarded, "192.0.2.99", "X-Forwarded-Prefix", "/evil", ""},
+		{"other with fixed", prefixSourceFixed, "192.0.2.99", "", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opt := base
+			opt.prefixSource = c.source
+			pr, err := newPrefixResolver(opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/", nil)
+			r.RemoteAddr = c.remote + ":12345"
+			if c.header != "" {
+				r.Header.Set(c.header, c.value)
+			}
+			if actual := pr.resolve(r); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_newPrefixResolver_requiresTrustedProxies(t *testing.T) {
+	for _, source := range []optionsPrefixSource{prefixSourceForwarded, prefixSourceFixed} {
+		t.Run(source.String(), func(t *testing.T) {
+			if _, err := newPrefixResolver(options{prefixSource: source, prefix: "/fixed"}); err == nil {
+				t.Errorf("expected error without trusted proxies")
+			}
+		})
+	}
+	if _, err := newPrefixResolver(options{prefixSource: prefixSourceIngress}); err != nil {
+		t.Errorf("expected no error; but got: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type optionsRole string
+
+const (
+	roleViewer   optionsRole = "viewer"
+	roleOperator optionsRole = "operator"
+	roleAdmin    optionsRole = "admin"
+)
+
+func parseOptionsRole(v string) (optionsRole, error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "":
+		return "", nil
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "admin", "administrator":
+		return roleAdmin, nil
+	default:
+		return "", fmt.Errorf("unknown role %q", v)
+	}
+}
+
+func (ol *optionsRole) UnmarshalText(text []byte) (err error) {
+	*ol, err = parseOptionsRole(string(text))
+	return err
+}
+
+func (ol optionsRole) MarshalText() ([]byte, error) {
+	return []byte(ol.String()), nil
+}
+
+// String returns the role. A missing role is treated as the least
+// privileged one.
+func (ol optionsRole) String() string {
+	if ol == "" {
+		return string(roleViewer)
+	}
+	return string(ol)
+}
+
+func (ol optionsRole) level() int {
+	switch optionsRole(ol.String()) {
+	case roleAdmin:
+		return 3
+	case roleOperator:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func (ol optionsRole) permits(required optionsRole) bool {
+	return ol.level() >= required.level()
+}
+
+type optionsAccessControlEntry struct {
+	User string      `json:"user"`
+	Role optionsRole `json:"role"`
+}
+
+type accessRule struct {
+	methods []string
+	path    *regexp.Regexp
+	role    optionsRole
+}
+
+func (ar accessRule) matches(r *http.Request) bool {
+	if len(ar.methods) > 0 {
+		found := false
+		for _, method := range ar.methods {
+			if method == r.Method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return ar.path.MatchString(accessPathOf(r))
+}
+
+// accessPathOf returns the path of the request the way Duplicati routes it:
+// case-insensitive and with empty or dot segments removed. Everything which
+// decides by the path (access rules, audit log, rate limit, ...) has to use
+// this one; otherwise /API/v1/... or //api/v1/... would bypass it.
+func accessPathOf(r *http.Request) string {
+	return strings.ToLower(path.Clean("/" + r.URL.Path))
+}
+
+var (
+	accessRules = []accessRule{{
+		// Exports contain the credentials of the backup destinations.
+		path: regexp.MustCompile(`^/api/v1/backup/[^/]+/export$`),
+		role: roleAdmin,
+	}, {
+		methods: []string{http.MethodPost},
+		path:    regexp.MustCompile(`^/api/v1/backup/[^/]+/(run|verify|compact|createreport)$`),
+		role:    roleOperator,
+	}, {
+		methods: []string{http.MethodPost},
+		path:    regexp.MustCompile(`^/api/v1/task/[^/]+/(stop|abort)$`),
+		role:    roleOperator,
+	}, {
+		methods: []string{http.MethodPost},
+		path:    regexp.MustCompile(`^/api/v1/serverstate/(pause|resume)$`),
+		role:    roleOperator,
+	}, {
+		methods: []string{http.MethodDelete},
+		path:    regexp.MustCompile(`^/api/v1/notification/[^/]+$`),
+		role:    roleOperator,
+	}, {
+		// Every GUI needs these to get going: refresh is answered by the
+		// wrapper itself (with a proxy-only token for users which are not
+		// admin) and signin requires the password of Duplicati anyway. Issuing
+		// signin tokens, which can be exchanged for real access tokens, is not
+		// covered here and therefore requires admin.
+		methods: []string{http.MethodPost},
+		path:    regexp.MustCompile(`^/api/v1/auth/(refresh|signin)$`),
+		role:    roleViewer,
+	}, {
+		// Everything viewers need to look at backups and logs. Everything
+		// else (like the configuration of a backup, server settings or the
+		// filesystem) reveals credentials or data and requires admin.
+		methods: []string{http.MethodGet, http.MethodHead},
+		path:    regexp.MustCompile(`^/api/v1/(backups|serverstate|progressstate|notifications|tasks|systeminfo|licenses|acknowledgements|changelog)$`),
+		role:    roleViewer,
+	}, {
+		methods: []string{http.MethodGet, http.MethodHead},
+		path:    regexp.MustCompile(`^/api/v1/(task/[^/]+|backup/[^/]+/(log|remotelog|filesets|isactive)|logdata/(log|poll)|uisettings(/[^/]+)?)$`),
+		role:    roleViewer,
+	}, {
+		methods: []string{http.MethodOptions},
+		path:    regexp.MustCompile(`.*`),
+		role:    roleViewer,
+	}}
+
+	// backupsListPath lists all backups including their configuration; for
+	// users which are not admin its secrets are redacted.
+	backupsListPath = "/api/v1/backups"
+)
+
+func isBackupsListPath(r *http.Request) bool {
+	return accessPathOf(r) == backupsListPath
+}
+
+// requiredRoleOf returns the role a user needs to perform the given request.
+// Everything which is not explicitly covered by an accessRule requires to be
+// admin, except reading the GUIs themselves.
+func requiredRoleOf(r *http.Request) optionsRole {
+	for _, rule := range accessRules {
+		if rule.matches(r) {
+			return rule.role
+		}
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(accessPathOf(r)+"/", "/api/") {
+		return roleViewer
+	}
+	return roleAdmin
+}
+
+// redactionRuleOf returns a rule which removes the secrets (like target URLs
+// with credentials or the passphrase) of the backup list for users which are
+// not admin.
+func (srv *server) redactionRuleOf(r *http.Request) (rewriteRule, bool) {
+	if !isBackupsListPath(r) || srv.roleOf(r).permits(roleAdmin) {
+		return rewriteRule{}, false
+	}
+	return rewriteRule{apply: func(b []byte, _ string) []byte {
+		var v any
+		if err := json.Unmarshal(b, &v); err != nil {
+			return []byte("[]")
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(redactJson(v)); err != nil {
+			return []byte("[]")
+		}
+		return buf.Bytes()
+	}}, true
+}
+
+func userOf(r *http.Request) (id, name string) {
+	return r.Header.Get("X-Remote-User-Id"), r.Header.Get("X-Remote-User-Name")
+}
+
+func (srv *server) roleOf(r *http.Request) optionsRole {
+	id, name := userOf(r)
+	for _, entry := range srv.options.accessControl {
+		if entry.User == "" {
+			continue
+		}
+		if (id != "" && strings.EqualFold(entry.User, id)) || (name != "" && strings.EqualFold(entry.User, name)) {
+			return entry.Role
+		}
+	}
+	// Every Home Assistant user can log in on the direct access port, while
+	// only administrators see the ingress panel; so the default role only
+	// applies to ingress.
+	if isDirectSession(r) {
+		return roleViewer
+	}
+	return srv.options.defaultRole
+}
+
+// authorize checks if the user of the request is permitted to perform it and
+// answers the request itself with 403 if not.
+func (srv *server) authorize(rw http.ResponseWriter, r *http.Request) bool {
+	role := srv.roleOf(r)
+	required := requiredRoleOf(r)
+	if role.permits(required) {
+		return true
+	}
+
+	id, name := userOf(r)
+	srv.loggerOf(r).With("uri", r.RequestURI).
+		With("method", r.Method).
+		With("userId", id).
+		With("user", name).
+		With("role", role).
+		With("requiredRole", required).
+		Warn("request denied by access control")
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(rw).Encode(struct {
+		Error   string `json:"Error"`
+		Code    int    `json:"Code"`
+		Role    string `json:"Role"`
+		Require string `json:"RequiredRole"`
+	}{
+		Error:   "You are not allowed to perform this action. The role " + required.String() + " is required, but you have the role " + role.String() + ".",
+		Code:    http.StatusForbidden,
+		Role:    role.String(),
+		Require: required.String(),
+	})
+	return false
+}
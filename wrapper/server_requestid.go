@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	log "github.com/echocat/slf4g"
+)
+
+const (
+	requestIdHeader = "X-Request-Id"
+)
+
+var (
+	requestIdRegexp = regexp.MustCompile(`^[A-Za-z0-9._:+=/-]{1,128}$`)
+)
+
+type requestIdKey struct{}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+func requestIdFrom(ctx context.Context) string {
+	v, _ := ctx.Value(requestIdKey{}).(string)
+	return v
+}
+
+func requestIdOf(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	return requestIdFrom(r.Context())
+}
+
+// resolveRequestId returns the correlation ID sent by the client (if it is a
+// sane one) or creates a new one.
+func resolveRequestId(r *http.Request) string {
+	if v := r.Header.Get(requestIdHeader); requestIdRegexp.MatchString(v) {
+		return v
+	}
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// requestLogger returns the given logger, enriched with the correlation ID of
+// the given request.
+func requestLogger(logger log.Logger, r *http.Request) log.Logger {
+	if id := requestIdOf(r); id != "" {
+		return logger.With("requestId", id)
+	}
+	return logger
+}
+
+func (srv *server) loggerOf(r *http.Request) log.Logger {
+	return requestLogger(srv.logger, r)
+}
+
+func (ds *directServer) loggerOf(r *http.Request) log.Logger {
+	return requestLogger(ds.logger, r)
+}
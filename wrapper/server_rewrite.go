@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	rewriteContentTypesHtml = []string{"text/html", "application/xhtml+xml"}
+	rewriteContentTypesCss  = []string{"text/css"}
+	rewriteContentTypesJs   = []string{"application/javascript", "text/javascript", "application/x-javascript"}
+
+	rewriteRules = []rewriteRule{{
+		contentTypes: rewriteContentTypesHtml,
+		apply:        rewriteHtml,
+	}, {
+		contentTypes: rewriteContentTypesCss,
+		apply:        rewriteCss,
+	}, {
+		gui:          guiNgax,
+		contentTypes: rewriteContentTypesJs,
+		apply:        rewriteJsCallSitesOf("/api/", "/ngax/", "/notifications"),
+	}, {
+		gui:          guiNgclient,
+		contentTypes: rewriteContentTypesJs,
+		apply:        rewriteJsCallSitesOf("/api/", "/ngclient/", "/notifications"),
+	}}
+
+	rewriteHtmlAttributesRegexp = regexp.MustCompile(`(?i)(\s(?:href|src|action|formaction|poster)\s*=\s*["'])(/[^"']*)`)
+	rewriteHtmlHeadRegexp       = regexp.MustCompile(`(?i)<head(?:\s[^>]*)?>`)
+	rewriteHtmlBaseRegexp       = regexp.MustCompile(`(?i)<base\s`)
+	rewriteCssUrlRegexp         = regexp.MustCompile(`(url\(\s*["']?)(/[^"')]*)`)
+	rewriteCssImportRegexp      = regexp.MustCompile(`(@import\s+["'])(/[^"']*)`)
+	rewriteRefreshUrlRegexp     = regexp.MustCompile(`(?i)^(\s*\d+\s*[;,]\s*url\s*=\s*["']?)([^"']*)`)
+)
+
+type rewriteRule struct {
+	// gui the rule is limited to, selected by the path of the request. An
+	// empty value applies the rule to every response.
+	gui          optionsGui
+	contentTypes []string
+	apply        func(b []byte, prefix string) []byte
+}
+
+func (rr rewriteRule) matches(gui optionsGui, contentType string) bool {
+	if rr.gui != "" && rr.gui != gui {
+		return false
+	}
+	for _, candidate := range rr.contentTypes {
+		if candidate == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+func rewriteRulesFor(path, contentType string) (result []rewriteRule) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	gui := guiOfPath(path)
+	for _, rule := range rewriteRules {
+		if rule.matches(gui, mediaType) {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+func guiOfPath(path string) optionsGui {
+	switch {
+	case strings.HasPrefix(path, guiNgax.initPath()):
+		return guiNgax
+	case strings.HasPrefix(path, guiNgclient.initPath()):
+		return guiNgclient
+	default:
+		return ""
+	}
+}
+
+func prefixAbsolutePath(path, prefix string) string {
+	if strings.HasPrefix(path, "//") {
+		// Protocol relative URL, which points to another host.
+		return path
+	}
+	if path == prefix || strings.HasPrefix(path, prefix+"/") {
+		return path
+	}
+	return prefix + path
+}
+
+func rewriteSubmatch(re *regexp.Regexp, b []byte, prefix string) []byte {
+	return re.ReplaceAllFunc(b, func(match []byte) []byte {
+		sm := re.FindSubmatch(match)
+		if len(sm) < 3 {
+			return match
+		}
+		return append(append([]byte{}, sm[1]...), prefixAbsolutePath(string(sm[2]), prefix)...)
+	})
+}
+
+// rewriteHtml prefixes the absolute paths of the given HTML and injects the
+// shim into documents. Fragments (like the templates of ngax) only get their
+// paths prefixed: jQuery runs the scripts of inserted HTML, so the shim would
+// run again (and fail) for each of them.
+func rewriteHtml(b []byte, prefix string) []byte {
+	b = rewriteSubmatch(rewriteHtmlAttributesRegexp, b, prefix)
+	b = rewriteSubmatch(rewriteCssUrlRegexp, b, prefix)
+
+	script := []byte(fixJsRequestsScript(prefix))
+	if loc := rewriteHtmlBaseRegexp.FindIndex(b); loc != nil {
+		return insertAt(b, loc[0], script)
+	}
+	if loc := rewriteHtmlHeadRegexp.FindIndex(b); loc != nil {
+		return insertAt(b, loc[1], script)
+	}
+	return b
+}
+
+func rewriteCss(b []byte, prefix string) []byte {
+	b = rewriteSubmatch(rewriteCssUrlRegexp, b, prefix)
+	b = rewriteSubmatch(rewriteCssImportRegexp, b, prefix)
+	return b
+}
+
+// rewriteJsCallSitesOf returns a rule which prefixes string literals starting
+// with one of the given paths, but only where the shim (see
+// server_rewritePrefixJs.js) cannot see them being used: assignments to
+// locations, href, src or action (also inside HTML templates) and the
+// attributes of compiled Angular templates. Everything else (like comparisons
+// with "/api/") is left untouched.
+func rewriteJsCallSitesOf(paths ...string) func(b []byte, prefix string) []byte {
+	quoted := make([]string, len(paths))
+	for i, path := range paths {
+		quoted[i] = regexp.QuoteMeta(path)
+	}
+	re := regexp.MustCompile(`((?:\b(?:location|href|src|action)\s*=|\blocation\.(?:assign|replace)\(|["'](?:href|src|action)["']\s*,)\s*\\?["'` + "`" + `])((?:` + strings.Join(quoted, "|") + `)[^"'` + "`" + `\\]*)`)
+	return func(b []byte, prefix string) []byte {
+		return rewriteSubmatch(re, b, prefix)
+	}
+}
+
+func insertAt(b []byte, i int, what []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(b) + len(what))
+	buf.Write(b[:i])
+	buf.Write(what)
+	buf.Write(b[i:])
+	return buf.Bytes()
+}
+
+func rewriteResponseHeaders(header http.Header, host, prefix string) {
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := header.Get(name); v != "" {
+			header.Set(name, rewriteLocation(v, host, prefix))
+		}
+	}
+	if v := header.Get("Refresh"); v != "" {
+		if sm := rewriteRefreshUrlRegexp.FindStringSubmatchIndex(v); sm != nil {
+			header.Set("Refresh", v[:sm[4]]+rewriteLocation(v[sm[4]:sm[5]], host, prefix)+v[sm[5]:])
+		}
+	}
+	if cookies := header.Values("Set-Cookie"); len(cookies) > 0 {
+		header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			header.Add("Set-Cookie", rewriteSetCookiePath(cookie, prefix))
+		}
+	}
+}
+
+func rewriteLocation(location, host, prefix string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	if u.Host != "" && !strings.EqualFold(u.Host, host) {
+		return location
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		// Relative to the current document, which is already below the prefix.
+		return location
+	}
+	u.Path = prefixAbsolutePath(u.Path, prefix)
+	u.RawPath = ""
+	return u.String()
+}
+
+func rewriteSetCookiePath(cookie, prefix string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		if i == 0 {
+			// The name and value of the cookie itself.
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(name), "path") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "/") {
+			continue
+		}
+		parts[i] = " Path=" + prefixAbsolutePath(value, prefix)
+	}
+	return strings.Join(parts, ";")
+}
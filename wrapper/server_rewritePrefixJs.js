@@ -1,18 +1,75 @@
 (() => {
+    const prefix = __wrapperPrefix__.replace(/\/+$/, "");
+
+    const isPrefixed = (path) => path === prefix || path.startsWith(prefix + '/');
+
+    const prefixPath = (path) => {
+        if (isPrefixed(path)) {
+            return path;
+        }
+        return prefix + "/" + path.replace(/^\/+/, "");
+    };
+
+    const isSameOrigin = (url) => {
+        return url.origin === window.location.origin
+            || (url.host === window.location.host && (url.protocol === "ws:" || url.protocol === "wss:"));
+    };
+
+    // Returns the given URL with the prefix applied if it is an absolute path
+    // (like "/api/v1/...") or a full qualified URL pointing to this origin.
+    // Relative URLs are left untouched, because these are resolved against
+    // the (already prefixed) document.
+    const rewriteUrl = (input) => {
+        if (input instanceof URL) {
+            if (!isSameOrigin(input) || isPrefixed(input.pathname)) {
+                return input;
+            }
+            const result = new URL(input.href);
+            result.pathname = prefixPath(input.pathname);
+            return result;
+        }
+        if (typeof input !== 'string') {
+            return input;
+        }
+        if (input.startsWith("//")) {
+            return input;
+        }
+        if (input.startsWith("/")) {
+            return prefixPath(input);
+        }
+        if (/^[a-z][a-z0-9+.-]*:/i.test(input)) {
+            try {
+                const url = new URL(input);
+                if (isSameOrigin(url) && !isPrefixed(url.pathname)) {
+                    url.pathname = prefixPath(url.pathname);
+                    return url.href;
+                }
+            } catch (ignored) {
+            }
+        }
+        return input;
+    };
+
+    const rewriteRequest = (input) => {
+        if (typeof Request !== 'undefined' && input instanceof Request) {
+            const url = new URL(input.url);
+            if (!isSameOrigin(url) || isPrefixed(url.pathname)) {
+                return input;
+            }
+            url.pathname = prefixPath(url.pathname);
+            return new Request(url.href, input);
+        }
+        return rewriteUrl(input);
+    };
+
     const originalFetch = window.fetch;
     window.fetch = function (input, init) {
-        if (typeof input === 'string' && input.startsWith('/api/')) {
-            input = __wrapperPrefix__ + input;
-        }
-        return originalFetch(input, init);
+        return originalFetch.call(this, rewriteRequest(input), init);
     };
 
     const originalOpen = XMLHttpRequest.prototype.open;
     XMLHttpRequest.prototype.open = function (method, url, ...args) {
-        if (url.startsWith('/api/')) {
-            url = __wrapperPrefix__ + url;
-        }
-        return originalOpen.call(this, method, url, ...args);
+        return originalOpen.call(this, method, rewriteUrl(url), ...args);
     };
 
     const originalWebSocket = window.WebSocket;
@@ -28,7 +85,7 @@
                     const base = new URL(document.baseURI || window.location.href);
                     return new URL(path, base).pathname;
                 })()
-                return __wrapperPrefix__.replace(/\/+$/, "") + "/" + absolutePath.replace(/^\/+/, "");
+                return prefixPath(absolutePath);
             } catch (e) {
                 return path;
             }
@@ -43,7 +100,7 @@
             }
             if (typeof url === 'string') {
                 url = InterceptingWebSocket.patchPath(url);
-            } else {
+            } else if (isSameOrigin(url)) {
                 url.pathname = InterceptingWebSocket.patchPath(url.pathname);
             }
             super(url, protocols);
@@ -52,5 +109,68 @@
     }
 
     window.WebSocket = InterceptingWebSocket;
-})();
 
+    if (typeof window.EventSource !== 'undefined') {
+        const originalEventSource = window.EventSource;
+
+        class InterceptingEventSource extends originalEventSource {
+            constructor(url, config) {
+                super(rewriteUrl(url), config);
+            }
+        }
+
+        window.EventSource = InterceptingEventSource;
+    }
+
+    if (typeof navigator !== 'undefined' && typeof navigator.sendBeacon === 'function') {
+        const originalSendBeacon = navigator.sendBeacon;
+        navigator.sendBeacon = function (url, data) {
+            return originalSendBeacon.call(this, rewriteUrl(url), data);
+        };
+    }
+
+    const originalWindowOpen = window.open;
+    window.open = function (url, ...args) {
+        return originalWindowOpen.call(this, rewriteUrl(url), ...args);
+    };
+
+    const patchAttribute = (element, name) => {
+        const value = element.getAttribute(name);
+        if (value === null) {
+            return;
+        }
+        const rewritten = rewriteUrl(value);
+        if (rewritten !== value) {
+            element.setAttribute(name, rewritten);
+        }
+    };
+
+    if (typeof HTMLFormElement !== 'undefined') {
+        const originalSubmit = HTMLFormElement.prototype.submit;
+        HTMLFormElement.prototype.submit = function () {
+            patchAttribute(this, "action");
+            return originalSubmit.call(this);
+        };
+    }
+
+    if (typeof document !== 'undefined' && typeof document.addEventListener === 'function') {
+        document.addEventListener("submit", (event) => {
+            const form = event.target;
+            if (form && typeof form.getAttribute === 'function') {
+                patchAttribute(form, "action");
+            }
+            const submitter = event.submitter;
+            if (submitter && typeof submitter.getAttribute === 'function') {
+                patchAttribute(submitter, "formaction");
+            }
+        }, true);
+
+        document.addEventListener("click", (event) => {
+            const target = event.target;
+            const anchor = target && typeof target.closest === 'function' ? target.closest("a[href]") : null;
+            if (anchor) {
+                patchAttribute(anchor, "href");
+            }
+        }, true);
+    }
+})();
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+const testShimOrigin = "https://ha.local:8123"
+
+// testShimBrowser emulates the parts of a browser the shim wraps. Every
+// wrapped entry point records the URL it was finally called with in calls.
+const testShimBrowser = `
+var window = globalThis;
+
+var URL = class URL {
+	constructor(input, base) {
+		Object.assign(this, __parseUrl(String(input), base === undefined ? "" : String(base)));
+	}
+	get origin() {
+		return this.host ? this.protocol + "//" + this.host : "null";
+	}
+	get href() {
+		return this.protocol + (this.host ? "//" + this.host : "") + this.pathname + this.search + this.hash;
+	}
+	toString() {
+		return this.href;
+	}
+};
+
+var calls = [];
+var record = (v) => calls.push(v instanceof URL ? "URL:" + v.href : String(v));
+
+window.location = {
+	origin: "` + testShimOrigin + `",
+	host: "ha.local:8123",
+	href: "` + testShimOrigin + `/prefix/ngax/index.html",
+};
+
+var listeners = {};
+var document = {
+	baseURI: "` + testShimOrigin + `/prefix/ngax/",
+	currentScript: {dataset: {prefix: "/prefix"}},
+	addEventListener(type, fn) {
+		(listeners[type] = listeners[type] || []).push(fn);
+	},
+};
+var dispatch = (type, event) => (listeners[type] || []).forEach((fn) => fn(event));
+
+var Request = class Request {
+	constructor(input, init) {
+		this.url = new URL(input, window.location.href).href;
+	}
+};
+window.fetch = function (input, init) {
+	record(input instanceof Request ? "Request:" + input.url : input);
+};
+
+function XMLHttpRequest() {
+}
+XMLHttpRequest.prototype.open = function (method, url) {
+	record(url);
+};
+
+var WebSocket = class WebSocket {
+	constructor(url) {
+		record(url);
+	}
+};
+var EventSource = class EventSource {
+	constructor(url) {
+		record(url);
+	}
+};
+var navigator = {
+	sendBeacon(url, data) {
+		record(url);
+		return true;
+	},
+};
+window.open = function (url) {
+	record(url);
+};
+
+var Element = class Element {
+	constructor(attrs, parent) {
+		this.attrs = attrs;
+		this.parent = parent;
+	}
+	getAttribute(name) {
+		return name in this.attrs ? this.attrs[name] : null;
+	}
+	setAttribute(name, value) {
+		this.attrs[name] = value;
+	}
+	closest(selector) {
+		for (let e = this; e; e = e.parent) {
+			if (selector === "a[href]" && e.tag === "a" && e.getAttribute("href") !== null) {
+				return e;
+			}
+		}
+		return null;
+	}
+};
+var HTMLFormElement = class HTMLFormElement extends Element {
+};
+HTMLFormElement.prototype.submit = function () {
+	record(this.getAttribute("action"));
+};
+`
+
+func newTestShimRuntime(t *testing.T) *goja.Runtime {
+	t.Helper()
+	vm := goja.New()
+	if err := vm.Set("__parseUrl", testShimParseUrl(vm)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.RunString(testShimBrowser); err != nil {
+		t.Fatalf("cannot setup browser: %v", err)
+	}
+	// This is exactly what is delivered to the browser.
+	if _, err := vm.RunString(fixJsRequestsScriptContent); err != nil {
+		t.Fatalf("cannot run shim: %v", err)
+	}
+	return vm
+}
+
+// testShimParseUrl backs the URL class of the emulated browser.
+func testShimParseUrl(vm *goja.Runtime) func(input, base string) map[string]any {
+	return func(input, base string) map[string]any {
+		u, err := url.Parse(input)
+		if err == nil && base != "" {
+			var b *url.URL
+			if b, err = url.Parse(base); err == nil {
+				u = b.ResolveReference(u)
+			}
+		}
+		if err != nil || !u.IsAbs() {
+			panic(vm.NewTypeError("Invalid URL: %s", input))
+		}
+		result := map[string]any{
+			"protocol": u.Scheme + ":",
+			"host":     u.Host,
+			"pathname": u.EscapedPath(),
+			"search":   "",
+			"hash":     "",
+		}
+		if u.Opaque != "" {
+			result["pathname"] = u.Opaque
+		} else if u.Host != "" && u.Path == "" {
+			result["pathname"] = "/"
+		}
+		if u.RawQuery != "" {
+			result["search"] = "?" + u.RawQuery
+		}
+		if u.Fragment != "" {
+			result["hash"] = "#" + u.EscapedFragment()
+		}
+		return result
+	}
+}
+
+// testShimUrls are the URLs every entry point is tested with, together with
+// the URL the wrapped function is expected to be called with.
+var testShimUrls = []struct {
+	name     string
+	input    string
+	expected string
+}{
+	{"absolute path", "/api/v1/backups", "/prefix/api/v1/backups"},
+	{"absolute path outside of api", "/ngclient/index.html", "/prefix/ngclient/index.html"},
+	{"root", "/", "/prefix/"},
+	{"already prefixed", "/prefix/api/v1/backups", "/prefix/api/v1/backups"},
+	{"prefix itself", "/prefix", "/prefix"},
+	{"similar to prefix", "/prefixed/api", "/prefix/prefixed/api"},
+	{"relative", "api/v1/backups", "api/v1/backups"},
+	{"relative to parent", "../api/v1/backups", "../api/v1/backups"},
+	{"same origin", testShimOrigin + "/api/v1/backups?a=b", testShimOrigin + "/prefix/api/v1/backups?a=b"},
+	{"same origin already prefixed", testShimOrigin + "/prefix/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+	{"cross origin", "https://example.org/api/v1/backups", "https://example.org/api/v1/backups"},
+	{"protocol relative", "//example.org/api/v1/backups", "//example.org/api/v1/backups"},
+	{"protocol relative same host", "//ha.local:8123/api/v1/backups", "//ha.local:8123/api/v1/backups"},
+	{"other scheme", "mailto:foo@example.org", "mailto:foo@example.org"},
+}
+
+func testShimCall(t *testing.T, vm *goja.Runtime, script string, input any) string {
+	t.Helper()
+	if err := vm.Set("input", input); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.RunString("calls = [];\n{\n" + script + "\n}"); err != nil {
+		t.Fatalf("cannot run %q: %v", script, err)
+	}
+	var calls []string
+	if err := vm.ExportTo(vm.Get("calls"), &calls); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("expected exactly one call of the original function; but got: %v", calls)
+	}
+	return calls[0]
+}
+
+func Test_rewritePrefixJs_stringEntryPoints(t *testing.T) {
+	entryPoints := map[string]string{
+		"fetch":       `fetch(input)`,
+		"xhr":         `new XMLHttpRequest().open("GET", input, true)`,
+		"eventSource": `new EventSource(input)`,
+		"sendBeacon":  `navigator.sendBeacon(input, "data")`,
+		"windowOpen":  `window.open(input, "_blank")`,
+		"formSubmit":  `new HTMLFormElement({action: input}).submit()`,
+	}
+	vm := newTestShimRuntime(t)
+	for name, script := range entryPoints {
+		t.Run(name, func(t *testing.T) {
+			for _, c := range testShimUrls {
+				t.Run(c.name, func(t *testing.T) {
+					if actual := testShimCall(t, vm, script, c.input); actual != c.expected {
+						t.Errorf("expected %q; but got: %q", c.expected, actual)
+					}
+				})
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_urlEntryPoints(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"same origin", testShimOrigin + "/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+		{"already prefixed", testShimOrigin + "/prefix/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+		{"cross origin", "https://example.org/api/v1/backups", "https://example.org/api/v1/backups"},
+	}
+	entryPoints := map[string]string{
+		"fetch":      `fetch(new URL(input))`,
+		"xhr":        `new XMLHttpRequest().open("GET", new URL(input))`,
+		"sendBeacon": `navigator.sendBeacon(new URL(input))`,
+		"windowOpen": `window.open(new URL(input))`,
+	}
+	vm := newTestShimRuntime(t)
+	for name, script := range entryPoints {
+		t.Run(name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					if actual := testShimCall(t, vm, script, c.input); actual != "URL:"+c.expected {
+						t.Errorf("expected %q; but got: %q", "URL:"+c.expected, actual)
+					}
+				})
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_fetchRequest(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"absolute path", "/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+		{"already prefixed", "/prefix/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+		{"relative", "api/v1/backups", testShimOrigin + "/prefix/ngax/api/v1/backups"},
+		{"same origin", testShimOrigin + "/api/v1/backups", testShimOrigin + "/prefix/api/v1/backups"},
+		{"cross origin", "https://example.org/api/v1/backups", "https://example.org/api/v1/backups"},
+		{"protocol relative", "//example.org/api/v1/backups", "https://example.org/api/v1/backups"},
+	}
+	vm := newTestShimRuntime(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := testShimCall(t, vm, `fetch(new Request(input))`, c.input); actual != "Request:"+c.expected {
+				t.Errorf("expected %q; but got: %q", "Request:"+c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_webSocket(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"absolute path", "/api/v1/notifications", "/prefix/api/v1/notifications"},
+		{"already prefixed", "/prefix/api/v1/notifications", "/prefix/api/v1/notifications"},
+		{"relative", "notifications", "/prefix/ngax/notifications"},
+		{"same host", "wss://ha.local:8123/api/v1/notifications", "URL:wss://ha.local:8123/prefix/api/v1/notifications"},
+		{"cross origin", "wss://example.org/api/v1/notifications", "URL:wss://example.org/api/v1/notifications"},
+	}
+	vm := newTestShimRuntime(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := testShimCall(t, vm, `new WebSocket(input)`, c.input); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_submitEvent(t *testing.T) {
+	vm := newTestShimRuntime(t)
+	for _, c := range testShimUrls {
+		t.Run(c.name, func(t *testing.T) {
+			script := `
+				const form = new HTMLFormElement({action: input});
+				const submitter = new Element({formaction: input}, form);
+				dispatch("submit", {target: form, submitter: submitter});
+				record(form.getAttribute("action") + " " + submitter.getAttribute("formaction"));
+			`
+			expected := c.expected + " " + c.expected
+			if actual := testShimCall(t, vm, script, c.input); actual != expected {
+				t.Errorf("expected %q; but got: %q", expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_anchorClick(t *testing.T) {
+	vm := newTestShimRuntime(t)
+	for _, c := range testShimUrls {
+		t.Run(c.name, func(t *testing.T) {
+			script := `
+				const anchor = new Element({href: input});
+				anchor.tag = "a";
+				const span = new Element({}, anchor);
+				dispatch("click", {target: span});
+				record(anchor.getAttribute("href"));
+			`
+			if actual := testShimCall(t, vm, script, c.input); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewritePrefixJs_clickOutsideOfAnchor(t *testing.T) {
+	vm := newTestShimRuntime(t)
+	script := `
+		const button = new Element({href: input});
+		dispatch("click", {target: button});
+		record(button.getAttribute("href"));
+	`
+	if actual := testShimCall(t, vm, script, "/api/v1/backups"); actual != "/api/v1/backups" {
+		t.Errorf("expected element which is no anchor to be untouched; but got: %q", actual)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+const testRewritePrefix = "/api/hassio_ingress/abc"
+
+func Test_rewriteHtml(t *testing.T) {
+	script := fixJsRequestsScript(testRewritePrefix)
+	cases := []struct {
+		name     string
+		in       string
+		expected string
+	}{{
+		// ngax has no <base>; the shim goes directly behind <head>.
+		name:     "ngaxWithoutBase",
+		in:       `<html ng-app="backupApp"><head><meta charset="utf-8"><link rel="stylesheet" href="styles/style.css"><link rel="stylesheet" href="/customized/custom.css"><script src="scripts/app.js"></script></head><body><a href="/ngclient/">new</a><img src="/img/logo.png"></body></html>`,
+		expected: `<html ng-app="backupApp"><head>` + script + `<meta charset="utf-8"><link rel="stylesheet" href="styles/style.css"><link rel="stylesheet" href="` + testRewritePrefix + `/customized/custom.css"><script src="scripts/app.js"></script></head><body><a href="` + testRewritePrefix + `/ngclient/">new</a><img src="` + testRewritePrefix + `/img/logo.png"></body></html>`,
+	}, {
+		// ngclient has a <base>; the shim has to run before it, and the base
+		// itself has to point below the prefix.
+		name:     "ngclientWithBase",
+		in:       `<!doctype html><html lang="en"><head><meta charset="utf-8"><title>Duplicati</title><base href="/ngclient/"><link rel="stylesheet" href="styles-5INURTSO.css" media="print" onload="this.media='all'"></head><body><app-root></app-root><script src="main-3Q2NKL4D.js" type="module"></script></body></html>`,
+		expected: `<!doctype html><html lang="en"><head><meta charset="utf-8"><title>Duplicati</title>` + script + `<base href="` + testRewritePrefix + `/ngclient/"><link rel="stylesheet" href="styles-5INURTSO.css" media="print" onload="this.media='all'"></head><body><app-root></app-root><script src="main-3Q2NKL4D.js" type="module"></script></body></html>`,
+	}, {
+		name:     "headWithAttributes",
+		in:       `<HTML><HEAD lang="en"><BASE HREF='/ngclient/'></HEAD></HTML>`,
+		expected: `<HTML><HEAD lang="en">` + script + `<BASE HREF='` + testRewritePrefix + `/ngclient/'></HEAD></HTML>`,
+	}, {
+		// Templates of ngax are loaded as fragments; they must not get the shim.
+		name:     "fragment",
+		in:       `<div><a href="/api/v1/backup/1/export">export</a><form action="/api/v1/restore"></form></div>`,
+		expected: `<div><a href="` + testRewritePrefix + `/api/v1/backup/1/export">export</a><form action="` + testRewritePrefix + `/api/v1/restore"></form></div>`,
+	}, {
+		name:     "ngaxTemplate",
+		in:       `<div class="state"><img src="/img/loader.gif"><script type="text/ng-template" id="dialog.html"><a href="/ngax/index.html#/">home</a></script></div>`,
+		expected: `<div class="state"><img src="` + testRewritePrefix + `/img/loader.gif"><script type="text/ng-template" id="dialog.html"><a href="` + testRewritePrefix + `/ngax/index.html#/">home</a></script></div>`,
+	}, {
+		name:     "untouched",
+		in:       `<head></head><a href="#/log">log</a><a href="https://duplicati.com/">x</a><a href="//cdn.example.com/x.js">x</a><a href="relative/path">x</a><a href="` + testRewritePrefix + `/ngax/">x</a>`,
+		expected: `<head>` + script + `</head><a href="#/log">log</a><a href="https://duplicati.com/">x</a><a href="//cdn.example.com/x.js">x</a><a href="relative/path">x</a><a href="` + testRewritePrefix + `/ngax/">x</a>`,
+	}, {
+		name:     "inlineStyle",
+		in:       `<head><style>.logo{background:url("/img/logo.png")}</style></head><div style="background-image: url(/img/bg.png)"></div>`,
+		expected: `<head>` + script + `<style>.logo{background:url("` + testRewritePrefix + `/img/logo.png")}</style></head><div style="background-image: url(` + testRewritePrefix + `/img/bg.png)"></div>`,
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := string(rewriteHtml([]byte(c.in), testRewritePrefix)); actual != c.expected {
+				t.Errorf("expected:\n%s\nbut got:\n%s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewriteCss(t *testing.T) {
+	cases := []struct {
+		in       string
+		expected string
+	}{
+		{`.a{background:url(/img/a.png)}`, `.a{background:url(` + testRewritePrefix + `/img/a.png)}`},
+		{`.a{background:url("/img/a.png")}`, `.a{background:url("` + testRewritePrefix + `/img/a.png")}`},
+		{`.a{background:url( '/img/a.png' )}`, `.a{background:url( '` + testRewritePrefix + `/img/a.png' )}`},
+		{`@font-face{src:url(/fonts/fa.woff2) format("woff2"),url(/fonts/fa.woff) format("woff")}`, `@font-face{src:url(` + testRewritePrefix + `/fonts/fa.woff2) format("woff2"),url(` + testRewritePrefix + `/fonts/fa.woff) format("woff")}`},
+		{`@import "/ngax/styles/base.css";`, `@import "` + testRewritePrefix + `/ngax/styles/base.css";`},
+		{`@import url("/ngax/styles/base.css");`, `@import url("` + testRewritePrefix + `/ngax/styles/base.css");`},
+
+		// Relative, other hosts, data URLs and already prefixed ones are left
+		// untouched.
+		{`.a{background:url(img/a.png)}`, `.a{background:url(img/a.png)}`},
+		{`.a{background:url(../img/a.png)}`, `.a{background:url(../img/a.png)}`},
+		{`.a{background:url(//cdn.example.com/a.png)}`, `.a{background:url(//cdn.example.com/a.png)}`},
+		{`.a{background:url(data:image/png;base64,AAAA)}`, `.a{background:url(data:image/png;base64,AAAA)}`},
+		{`.a{background:url(` + testRewritePrefix + `/img/a.png)}`, `.a{background:url(` + testRewritePrefix + `/img/a.png)}`},
+		{`@import "base.css";`, `@import "base.css";`},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			if actual := string(rewriteCss([]byte(c.in), testRewritePrefix)); actual != c.expected {
+				t.Errorf("expected:\n%s\nbut got:\n%s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewriteJsCallSites(t *testing.T) {
+	p := testRewritePrefix
+	cases := []struct {
+		gui      optionsGui
+		in       string
+		expected string
+	}{
+		// Call sites the shim cannot see.
+		{guiNgax, `window.location.href = '/ngax/index.html#/';`, `window.location.href = '` + p + `/ngax/index.html#/';`},
+		{guiNgax, `window.location='/ngax/index.html'`, `window.location='` + p + `/ngax/index.html'`},
+		{guiNgax, `location.replace("/ngax/login.html")`, `location.replace("` + p + `/ngax/login.html")`},
+		{guiNgax, `location.assign( "/api/v1/backup/" + id + "/export")`, `location.assign( "` + p + `/api/v1/backup/" + id + "/export")`},
+		{guiNgax, `a.href="/api/v1/backup/"+id+"/export";a.click()`, `a.href="` + p + `/api/v1/backup/"+id+"/export";a.click()`},
+		{guiNgax, `img.src = '/api/v1/systeminfo/logo'`, `img.src = '` + p + `/api/v1/systeminfo/logo'`},
+		{guiNgax, `e.setAttribute("href","/ngax/index.html")`, `e.setAttribute("href","` + p + `/ngax/index.html")`},
+		{guiNgax, `template:'<a href="/ngax/index.html#/log">log</a>'`, `template:'<a href="` + p + `/ngax/index.html#/log">log</a>'`},
+		{guiNgclient, `window.location.href=` + "`/ngclient/restore/${id}`", `window.location.href=` + "`" + p + "/ngclient/restore/${id}`"},
+		{guiNgclient, `const e=[["href","/ngclient/settings"],[1,"logo"]]`, `const e=[["href","` + p + `/ngclient/settings"],[1,"logo"]]`},
+		{guiNgclient, `i.innerHTML="<a href=\"/api/v1/backup/1/export\">x</a>"`, `i.innerHTML="<a href=\"` + p + `/api/v1/backup/1/export\">x</a>"`},
+		{guiNgclient, `window.location.href="/ngclient/"`, `window.location.href="` + p + `/ngclient/"`},
+
+		// Everything else is either covered by the shim or not a URL at all.
+		{guiNgax, `if (url.startsWith("/api/")) {`, `if (url.startsWith("/api/")) {`},
+		{guiNgax, `return e.url.indexOf('/api/v1/auth')>=0`, `return e.url.indexOf('/api/v1/auth')>=0`},
+		{guiNgax, `if(e.href=="/ngax/index.html")`, `if(e.href=="/ngax/index.html")`},
+		{guiNgax, `if(location.href==="/ngax/")`, `if(location.href==="/ngax/")`},
+		{guiNgax, `$http.get('/api/v1/backups')`, `$http.get('/api/v1/backups')`},
+		{guiNgclient, `this.http.get("/api/v1/serverstate")`, `this.http.get("/api/v1/serverstate")`},
+		{guiNgclient, `new WebSocket("/notifications")`, `new WebSocket("/notifications")`},
+		{guiNgclient, `const API="/api/v1";fetch(API+"/backups")`, `const API="/api/v1";fetch(API+"/backups")`},
+		{guiNgclient, `location.href="/other/path"`, `location.href="/other/path"`},
+		{guiNgclient, `location.href="` + p + `/ngclient/"`, `location.href="` + p + `/ngclient/"`},
+
+		// Each GUI only rewrites its own paths.
+		{guiNgax, `location.href="/ngclient/"`, `location.href="/ngclient/"`},
+		{guiNgclient, `location.href="/ngax/"`, `location.href="/ngax/"`},
+	}
+	for _, c := range cases {
+		t.Run(c.gui.String()+" "+c.in, func(t *testing.T) {
+			rules := rewriteRulesFor(c.gui.initPath()+"main.js", "application/javascript; charset=utf-8")
+			if len(rules) != 1 {
+				t.Fatalf("expected exactly one rule; but got: %d", len(rules))
+			}
+			if actual := string(rules[0].apply([]byte(c.in), p)); actual != c.expected {
+				t.Errorf("expected:\n%s\nbut got:\n%s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewriteRulesFor(t *testing.T) {
+	cases := []struct {
+		path        string
+		contentType string
+		expected    int
+	}{
+		{"/ngax/index.html", "text/html; charset=utf-8", 1},
+		{"/ngclient/", "text/html", 1},
+		{"/ngax/styles/style.css", "text/css", 1},
+		{"/ngax/scripts/app.js", "application/javascript", 1},
+		{"/ngclient/main.js", "text/javascript", 1},
+		// Scripts outside the GUIs are not rewritten.
+		{"/customized/custom.js", "application/javascript", 0},
+		{"/api/v1/backups", "application/json", 0},
+		{"/ngax/index.html", "", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.path+" "+c.contentType, func(t *testing.T) {
+			if actual := len(rewriteRulesFor(c.path, c.contentType)); actual != c.expected {
+				t.Errorf("expected %d rules; but got: %d", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewriteResponseHeaders(t *testing.T) {
+	p := testRewritePrefix
+	cases := []struct {
+		name     string
+		header   string
+		in       string
+		expected string
+	}{
+		{"absolutePath", "Location", "/ngax/index.html", p + "/ngax/index.html"},
+		{"absolutePathWithQuery", "Location", "/ngax/index.html?x=1#/log", p + "/ngax/index.html?x=1#/log"},
+		{"root", "Location", "/", p + "/"},
+		{"relative", "Location", "index.html", "index.html"},
+		{"relativeParent", "Location", "../ngclient/", "../ngclient/"},
+		{"sameHost", "Location", "http://ha.local:8123/ngclient/", "http://ha.local:8123" + p + "/ngclient/"},
+		{"sameHostOtherCase", "Location", "https://HA.local:8123/api/v1/backups", "https://HA.local:8123" + p + "/api/v1/backups"},
+		{"otherHost", "Location", "https://duplicati.com/ngclient/", "https://duplicati.com/ngclient/"},
+		{"otherPort", "Location", "http://ha.local:8200/ngclient/", "http://ha.local:8200/ngclient/"},
+		{"protocolRelative", "Location", "//evil.com/ngclient/", "//evil.com/ngclient/"},
+		{"alreadyPrefixed", "Location", p + "/ngax/", p + "/ngax/"},
+		{"alreadyPrefixedExactly", "Location", p, p},
+		{"similarToPrefix", "Location", p + "x/ngax/", p + p + "x/ngax/"},
+		{"contentLocation", "Content-Location", "/api/v1/backup/1", p + "/api/v1/backup/1"},
+		{"contentLocationOtherHost", "Content-Location", "https://duplicati.com/x", "https://duplicati.com/x"},
+		{"refresh", "Refresh", "5; url=/ngax/index.html", "5; url=" + p + "/ngax/index.html"},
+		{"refreshQuoted", "Refresh", "0;URL='/ngclient/'", "0;URL='" + p + "/ngclient/'"},
+		{"refreshRelative", "Refresh", "0; url=index.html", "0; url=index.html"},
+		{"refreshOtherHost", "Refresh", "0; url=https://duplicati.com/", "0; url=https://duplicati.com/"},
+		{"refreshWithoutUrl", "Refresh", "30", "30"},
+		{"setCookieRoot", "Set-Cookie", "session=abc; Path=/; HttpOnly", "session=abc; Path=" + p + "/; HttpOnly"},
+		{"setCookieApi", "Set-Cookie", "RefreshToken_8200=abc; expires=Wed, 21 Oct 2026 07:28:00 GMT; path=/api/v1/auth; secure; samesite=strict; httponly", "RefreshToken_8200=abc; expires=Wed, 21 Oct 2026 07:28:00 GMT; Path=" + p + "/api/v1/auth; secure; samesite=strict; httponly"},
+		{"setCookieWithoutPath", "Set-Cookie", "session=abc; HttpOnly", "session=abc; HttpOnly"},
+		{"setCookieRelativePath", "Set-Cookie", "session=abc; Path=ngax", "session=abc; Path=ngax"},
+		{"setCookieAlreadyPrefixed", "Set-Cookie", "session=abc; Path=" + p + "/", "session=abc; Path=" + p + "/"},
+		{"setCookieValueLooksLikePath", "Set-Cookie", "path=/x; Path=/", "path=/x; Path=" + p + "/"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set(c.header, c.in)
+			rewriteResponseHeaders(h, "ha.local:8123", p)
+			if actual := h.Get(c.header); actual != c.expected {
+				t.Errorf("expected %q; but got: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_rewriteResponseHeaders_multipleCookies(t *testing.T) {
+	h := http.Header{}
+	h.Add("Set-Cookie", "a=1; Path=/")
+	h.Add("Set-Cookie", "b=2; Path=/api/v1/auth")
+	rewriteResponseHeaders(h, "ha.local:8123", testRewritePrefix)
+	expected := []string{"a=1; Path=" + testRewritePrefix + "/", "b=2; Path=" + testRewritePrefix + "/api/v1/auth"}
+	if actual := h.Values("Set-Cookie"); !slices.Equal(actual, expected) {
+		t.Errorf("expected %q; but got: %q", expected, actual)
+	}
+}
+
+// Test_server_interceptResponse_rewritesHeadersOfAllMethods ensures that
+// redirects and cookies are also rewritten for responses which body is not
+// rewritten (like the ones of POST requests).
+func Test_server_interceptResponse_rewritesHeadersOfAllMethods(t *testing.T) {
+	srv := &server{logger: log.GetLogger("test"), state: newState()}
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions} {
+		t.Run(method, func(t *testing.T) {
+			r := httptest.NewRequest(method, "http://ha.local:8123/api/v1/auth/login", nil)
+			r = r.WithContext(withPrefix(r.Context(), testRewritePrefix))
+			rsp := &http.Response{
+				StatusCode: http.StatusFound,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    r,
+			}
+			rsp.Header.Set("Location", "/ngclient/")
+			rsp.Header.Add("Set-Cookie", "RefreshToken=abc; Path=/api/v1/auth; HttpOnly")
+
+			if err := srv.interceptResponse(rsp); err != nil {
+				t.Fatal(err)
+			}
+
+			if expected, actual := testRewritePrefix+"/ngclient/", rsp.Header.Get("Location"); actual != expected {
+				t.Errorf("expected Location %q; but got: %q", expected, actual)
+			}
+			if expected, actual := "RefreshToken=abc; Path="+testRewritePrefix+"/api/v1/auth; HttpOnly", rsp.Header.Get("Set-Cookie"); actual != expected {
+				t.Errorf("expected Set-Cookie %q; but got: %q", expected, actual)
+			}
+		})
+	}
+}
+
+func Test_server_interceptResponse_keepsHeadersWithoutPrefix(t *testing.T) {
+	srv := &server{logger: log.GetLogger("test"), state: newState()}
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:8200/api/v1/auth/login", nil)
+	rsp := &http.Response{
+		StatusCode: http.StatusFound,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+	rsp.Header.Set("Location", "/ngclient/")
+	rsp.Header.Set("Set-Cookie", "a=1; Path=/")
+
+	if err := srv.interceptResponse(rsp); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := rsp.Header.Get("Location"); actual != "/ngclient/" {
+		t.Errorf("expected Location to be untouched; but got: %q", actual)
+	}
+	if actual := rsp.Header.Get("Set-Cookie"); actual != "a=1; Path=/" {
+		t.Errorf("expected Set-Cookie to be untouched; but got: %q", actual)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	cspWrapperScriptPlaceholder = "'wrapper-script'"
+	cspGuiHandlersPlaceholder   = "'gui-handlers'"
+
+	contentSecurityPolicyDefault = "default-src 'self'; " +
+		"script-src 'self' 'unsafe-eval' " + cspWrapperScriptPlaceholder + " " + cspGuiHandlersPlaceholder + "; " +
+		"style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data: blob:; " +
+		"font-src 'self' data:; " +
+		"connect-src 'self'; " +
+		"object-src 'none'; " +
+		"base-uri 'self'; " +
+		"form-action 'self'; " +
+		"frame-ancestors 'self'"
+)
+
+var (
+	rewritePrefixJsHash = cspHashOf(fixJsRequestsScriptContent)
+
+	// cspGuiHandlers are the inline event handlers the GUIs themselves contain,
+	// like the one Angular adds to load its stylesheet asynchronously.
+	cspGuiHandlers = []string{
+		"this.media='all'",
+	}
+
+	cspGuiHandlersSources = func(in []string) string {
+		result := []string{"'unsafe-hashes'"}
+		for _, handler := range in {
+			result = append(result, cspHashOf(handler))
+		}
+		return strings.Join(result, " ")
+	}(cspGuiHandlers)
+)
+
+func cspHashOf(in string) string {
+	sum := sha256.Sum256([]byte(in))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}
+
+// applySecurityHeaders adds the configured security headers. Inline scripts
+// are only allowed for the script injected by the wrapper and the known event
+// handlers of the GUIs (by their hashes); everything else which reaches a page
+// that way stays blocked.
+func (srv *server) applySecurityHeaders(h http.Header) {
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "same-origin")
+
+	if !isHtmlContentType(h.Get("Content-Type")) {
+		return
+	}
+	h.Set("X-Frame-Options", "SAMEORIGIN")
+	h.Set("Content-Security-Policy", srv.contentSecurityPolicy())
+}
+
+func (srv *server) contentSecurityPolicy() string {
+	result := srv.options.contentSecurityPolicy
+	if result == "" {
+		result = contentSecurityPolicyDefault
+		if len(srv.allowedHosts) > 0 {
+			ancestors := make([]string, 0, len(srv.allowedHosts))
+			for _, host := range srv.allowedHosts {
+				ancestors = append(ancestors, "https://"+host, "http://"+host)
+			}
+			result += " " + strings.Join(ancestors, " ")
+		}
+	}
+	return strings.NewReplacer(
+		cspWrapperScriptPlaceholder, rewritePrefixJsHash,
+		cspGuiHandlersPlaceholder, cspGuiHandlersSources,
+	).Replace(result)
+}
+
+func isHtmlContentType(contentType string) bool {
+	for _, candidate := range rewriteContentTypesHtml {
+		if strings.HasPrefix(contentType, candidate) {
+			return true
+		}
+	}
+	return false
+}
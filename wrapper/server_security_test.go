@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+var (
+	testInlineScriptRegexp  = regexp.MustCompile(`(?is)<script(\s[^>]*)?>(.*?)</script\s*>`)
+	testScriptSrcRegexp     = regexp.MustCompile(`(?i)\ssrc\s*=`)
+	testEventHandlerRegexp  = regexp.MustCompile(`(?i)\son[a-z]+\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	testJavascriptUrlRegexp = regexp.MustCompile(`(?i)\s(?:href|src|action)\s*=\s*["']?\s*javascript:`)
+)
+
+// testGuiIndexPages are the index pages of the GUIs (shortened), modelled on
+// the bundled Duplicati release.
+var testGuiIndexPages = map[string]string{
+	"/ngax/index.html":     "testdata/ngax-index.html",
+	"/ngclient/index.html": "testdata/ngclient-index.html",
+	"/ngclient/":           "testdata/ngclient-index.html",
+}
+
+// Test_server_interceptResponse_cspAllowsGuiIndexPages ensures that the CSP
+// sent with the index pages of the GUIs allows everything inline these
+// contain (after being rewritten by the wrapper) - but nothing more.
+func Test_server_interceptResponse_cspAllowsGuiIndexPages(t *testing.T) {
+	for path, fn := range testGuiIndexPages {
+		for _, prefix := range []string{"", "/api/hassio_ingress/abc"} {
+			t.Run(path+" "+prefix, func(t *testing.T) {
+				body, err := os.ReadFile(fn)
+				if err != nil {
+					t.Fatal(err)
+				}
+				srv := &server{
+					options: options{securityHeaders: true, guiSwitcher: true},
+					logger:  log.GetLogger("test"),
+					state:   newState(),
+				}
+				r := httptest.NewRequest(http.MethodGet, "http://localhost"+path, nil)
+				r = r.WithContext(withPrefix(r.Context(), prefix))
+				rsp := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{},
+					Body:          io.NopCloser(strings.NewReader(string(body))),
+					ContentLength: int64(len(body)),
+					Request:       r,
+				}
+				rsp.Header.Set("Content-Type", "text/html; charset=utf-8")
+				rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+				if err := srv.interceptResponse(rsp); err != nil {
+					t.Fatal(err)
+				}
+
+				b, err := io.ReadAll(rsp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertCspAllowsInline(t, rsp.Header.Get("Content-Security-Policy"), string(b))
+			})
+		}
+	}
+}
+
+func Test_server_contentSecurityPolicy_blocksUnknownInline(t *testing.T) {
+	srv := &server{options: options{securityHeaders: true}}
+	csp := srv.contentSecurityPolicy()
+	sources := cspSourcesOf(csp, "script-src")
+	for _, unexpected := range []string{"'unsafe-inline'", cspHashOf("alert(1)"), cspWrapperScriptPlaceholder, cspGuiHandlersPlaceholder} {
+		if slices.Contains(sources, unexpected) {
+			t.Errorf("expected %s not to be allowed; but got: %s", unexpected, csp)
+		}
+	}
+}
+
+func assertCspAllowsInline(t *testing.T, csp, body string) {
+	t.Helper()
+	sources := cspSourcesOf(csp, "script-src")
+	if len(sources) == 0 {
+		t.Fatalf("expected a script-src directive; but got: %s", csp)
+	}
+	if slices.Contains(sources, "'unsafe-inline'") {
+		t.Fatalf("expected inline scripts not to be allowed in general; but got: %s", csp)
+	}
+
+	for _, m := range testInlineScriptRegexp.FindAllStringSubmatch(body, -1) {
+		if testScriptSrcRegexp.MatchString(m[1]) {
+			continue
+		}
+		if !slices.Contains(sources, cspHashOf(m[2])) {
+			t.Errorf("expected inline script to be allowed by the CSP; but it is not: %s", m[0])
+		}
+	}
+	for _, m := range testEventHandlerRegexp.FindAllStringSubmatch(body, -1) {
+		handler := m[1] + m[2]
+		if !slices.Contains(sources, "'unsafe-hashes'") || !slices.Contains(sources, cspHashOf(handler)) {
+			t.Errorf("expected inline event handler to be allowed by the CSP; but it is not: %s", m[0])
+		}
+	}
+	if m := testJavascriptUrlRegexp.FindString(body); m != "" {
+		t.Errorf("expected no javascript: URLs, which cannot be allowed by hash; but got: %s", m)
+	}
+}
+
+func cspSourcesOf(csp, directive string) []string {
+	for _, part := range strings.Split(csp, ";") {
+		fields := strings.Fields(part)
+		if len(fields) > 0 && strings.EqualFold(fields[0], directive) {
+			return fields[1:]
+		}
+	}
+	return nil
+}
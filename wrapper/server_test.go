@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+func Test_server_proxy_logsWithRequestId(t *testing.T) {
+	output := withTestLogOutput(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Promise more than is sent, so the body breaks while it is copied.
+		w.Header().Set("Content-Length", "1000")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("partial"))
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = conn.Close()
+	}))
+	defer upstream.Close()
+	upstreamUrl, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{
+		logger: log.GetLogger("test"),
+		state:  newState(),
+	}
+	srv.reverseProxy.Rewrite = func(pr *httputil.ProxyRequest) {
+		pr.SetURL(upstreamUrl)
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/ngclient/main.js", nil)
+	r = r.WithContext(withRequestId(r.Context(), "test-request-id"))
+
+	srv.proxy(httptest.NewRecorder(), r)
+
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if !strings.Contains(line, "test-request-id") {
+			t.Errorf("expected every line to contain the request ID; but got: %s", line)
+		}
+	}
+	if actual := output.String(); !strings.Contains(actual, "read error during body copy") {
+		t.Errorf("expected the broken body to be logged; but got: %s", actual)
+	}
+}
+
+func Test_server_handleProxyError_logsWithRequestId(t *testing.T) {
+	output := withTestLogOutput(t)
+	srv := &server{
+		logger: log.GetLogger("test"),
+		state:  newState(),
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/api/v1/backups", nil)
+	r = r.WithContext(withRequestId(r.Context(), "test-request-id"))
+	rw := httptest.NewRecorder()
+
+	srv.handleProxyError(rw, r, errors.New("connection refused"))
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503; but got: %d", rw.Code)
+	}
+	if actual := output.String(); !strings.Contains(actual, "connection refused") || !strings.Contains(actual, "test-request-id") {
+		t.Errorf("expected the error to be logged with the request ID; but got: %s", actual)
+	}
+}
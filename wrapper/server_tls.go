@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/echocat/slf4g"
+)
+
+const (
+	sslDirectoryDefault = "/homeassistant/ssl"
+	sslDirectoryEnvVar  = "SSL_DIRECTORY"
+
+	certificateCheckInterval = 10 * time.Second
+)
+
+func newTlsConfig(opt options) (*tls.Config, error) {
+	certFile, err := sslFile(opt.certFile)
+	if err != nil {
+		return nil, fmt.Errorf("illegal certfile: %w", err)
+	}
+	keyFile, err := sslFile(opt.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("illegal keyfile: %w", err)
+	}
+	reloader, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &tls.Config{
+		MinVersion:     opt.tlsMinVersion.get(),
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if opt.tlsClientCaFile != "" {
+		caFile, err := sslFile(opt.tlsClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("illegal tls_client_ca_file: %w", err)
+		}
+		b, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read client CA file %q: %w", caFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("client CA file %q does not contain any PEM encoded certificate", caFile)
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return result, nil
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	result := &certificateReloader{
+		logger:   log.GetLogger("tls").With("certfile", certFile).With("keyfile", keyFile),
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := result.reload(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// certificateReloader serves the certificate of the given files and reloads
+// it as soon as one of these files was modified (e.g. by a renewal).
+type certificateReloader struct {
+	logger   log.Logger
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func (cr *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	if time.Since(cr.lastCheck) >= certificateCheckInterval {
+		cr.lastCheck = time.Now()
+		if cr.modified() {
+			if err := cr.reloadUnsafe(); err != nil {
+				// Keep serving the previous certificate until the files are fixed.
+				cr.logger.WithError(err).Error("cannot reload certificate; continue with previous one")
+			} else {
+				cr.logger.Info("certificate reloaded")
+			}
+		}
+	}
+
+	return cr.certificate, nil
+}
+
+func (cr *certificateReloader) modified() bool {
+	certModTime, keyModTime, err := cr.modTimes()
+	if err != nil {
+		return false
+	}
+	return !certModTime.Equal(cr.certModTime) || !keyModTime.Equal(cr.keyModTime)
+}
+
+func (cr *certificateReloader) modTimes() (certModTime, keyModTime time.Time, err error) {
+	fi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("cannot stat certificate file %q: %w", cr.certFile, err)
+	}
+	certModTime = fi.ModTime()
+	if fi, err = os.Stat(cr.keyFile); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("cannot stat key file %q: %w", cr.keyFile, err)
+	}
+	keyModTime = fi.ModTime()
+	return certModTime, keyModTime, nil
+}
+
+func (cr *certificateReloader) reload() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	return cr.reloadUnsafe()
+}
+
+func (cr *certificateReloader) reloadUnsafe() error {
+	certModTime, keyModTime, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate %q with key %q: %w", cr.certFile, cr.keyFile, err)
+	}
+	cr.certificate = &certificate
+	cr.certModTime, cr.keyModTime = certModTime, keyModTime
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// sslFile resolves the given file inside the SSL directory. It is either
+// relative to it or an absolute path inside of it.
+func sslFile(fn string) (string, error) {
+	fn = strings.TrimSpace(fn)
+	if fn == "" {
+		return "", fmt.Errorf("no file configured")
+	}
+	dir := sslDirectory()
+	rel := fn
+	if filepath.IsAbs(fn) {
+		var err error
+		if rel, err = filepath.Rel(dir, fn); err != nil {
+			return "", fmt.Errorf("%q is not located inside of the SSL directory %s", fn, dir)
+		}
+	}
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%q is not located inside of the SSL directory %s", fn, dir)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+func sslDirectory() string {
+	if v := os.Getenv(sslDirectoryEnvVar); v != "" {
+		return v
+	}
+	return sslDirectoryDefault
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTestSslDirectory provides an (empty) SSL directory.
+func withTestSslDirectory(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv(sslDirectoryEnvVar, dir)
+	return dir
+}
+
+// writeTestCertificate writes a new self-signed certificate and its key into
+// the given files and returns the DER of the certificate.
+func writeTestCertificate(t *testing.T, certFile, keyFile string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "duplicati.local"},
+		DNSNames:              []string{"duplicati.local"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+	return der
+}
+
+// writeTestFile writes the given content and moves the modification time
+// forward, as the reloader would not notice a change within the resolution of
+// the file system otherwise.
+func writeTestFile(t *testing.T, fn string, content []byte) {
+	t.Helper()
+	var modTime time.Time
+	if fi, err := os.Stat(fn); err == nil {
+		modTime = fi.ModTime().Add(time.Second)
+	} else {
+		modTime = time.Now()
+	}
+	if err := os.WriteFile(fn, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fn, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func certificateOf(t *testing.T, cr *certificateReloader) []byte {
+	t.Helper()
+	// Pretend the last check was long ago.
+	cr.mutex.Lock()
+	cr.lastCheck = time.Time{}
+	cr.mutex.Unlock()
+	c, err := cr.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Certificate[0]
+}
+
+func Test_certificateReloader_reloadsModifiedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	first := writeTestCertificate(t, certFile, keyFile)
+
+	cr, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, first) {
+		t.Errorf("expected initial certificate")
+	}
+
+	// Renewed certificate and key.
+	second := writeTestCertificate(t, certFile, keyFile)
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, second) {
+		t.Errorf("expected renewed certificate")
+	}
+
+	// Within the check interval nothing is checked.
+	third := writeTestCertificate(t, certFile, keyFile)
+	if c, err := cr.getCertificate(&tls.ClientHelloInfo{}); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(c.Certificate[0], second) {
+		t.Errorf("expected certificate not to be checked within the interval")
+	}
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, third) {
+		t.Errorf("expected renewed certificate after the interval")
+	}
+}
+
+func Test_certificateReloader_keepsCertificateOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+	first := writeTestCertificate(t, certFile, keyFile)
+	cr, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the certificate was written yet; it does not match the key.
+	other := t.TempDir()
+	writeTestCertificate(t, filepath.Join(other, "fullchain.pem"), filepath.Join(other, "privkey.pem"))
+	b, err := os.ReadFile(filepath.Join(other, "fullchain.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, certFile, b)
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, first) {
+		t.Errorf("expected previous certificate to be kept for a mismatching key")
+	}
+
+	// A broken key.
+	writeTestFile(t, keyFile, []byte("broken"))
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, first) {
+		t.Errorf("expected previous certificate to be kept for a broken key")
+	}
+
+	// A missing file.
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, first) {
+		t.Errorf("expected previous certificate to be kept for a missing key")
+	}
+
+	// Once fixed, it is reloaded.
+	fixed := writeTestCertificate(t, certFile, keyFile)
+	if actual := certificateOf(t, cr); !bytes.Equal(actual, fixed) {
+		t.Errorf("expected fixed certificate")
+	}
+}
+
+func Test_newCertificateReloader_failsForBrokenFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem")
+
+	if _, err := newCertificateReloader(certFile, keyFile); err == nil {
+		t.Errorf("expected error for missing files; but got none")
+	}
+	writeTestCertificate(t, certFile, keyFile)
+	writeTestFile(t, keyFile, []byte("broken"))
+	if _, err := newCertificateReloader(certFile, keyFile); err == nil {
+		t.Errorf("expected error for broken key; but got none")
+	}
+}
+
+func Test_sslFile(t *testing.T) {
+	dir := withTestSslDirectory(t)
+	cases := []struct {
+		fn       string
+		expected string
+	}{
+		{"fullchain.pem", filepath.Join(dir, "fullchain.pem")},
+		{" fullchain.pem ", filepath.Join(dir, "fullchain.pem")},
+		{"duplicati/fullchain.pem", filepath.Join(dir, "duplicati", "fullchain.pem")},
+		{"duplicati/../fullchain.pem", filepath.Join(dir, "fullchain.pem")},
+		{filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "fullchain.pem")},
+		{"", ""},
+		{"..", ""},
+		{"../fullchain.pem", ""},
+		{"duplicati/../../fullchain.pem", ""},
+		{"/data/options.json", ""},
+		{filepath.Join(dir, "..", "fullchain.pem"), ""},
+		{dir + "-other/fullchain.pem", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.fn, func(t *testing.T) {
+			actual, err := sslFile(c.fn)
+			if c.expected == "" {
+				if err == nil {
+					t.Errorf("expected error; but got: %s", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != c.expected {
+				t.Errorf("expected %s; but got: %s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_newTlsConfig(t *testing.T) {
+	dir := withTestSslDirectory(t)
+	ca := writeTestCertificate(t, filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem"))
+	writeTestFile(t, filepath.Join(dir, "ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca}))
+
+	cases := []struct {
+		name               string
+		minVersion         optionsTlsVersion
+		clientCaFile       string
+		expectedMinVersion uint16
+		expectedClientAuth tls.ClientAuthType
+	}{
+		{"default", "", "", tls.VersionTLS12, tls.NoClientCert},
+		{"tls12", "1.2", "", tls.VersionTLS12, tls.NoClientCert},
+		{"tls13", "1.3", "", tls.VersionTLS13, tls.NoClientCert},
+		{"clientCa", "1.3", "ca.pem", tls.VersionTLS13, tls.RequireAndVerifyClientCert},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := newTlsConfig(options{
+				certFile:        "fullchain.pem",
+				keyFile:         "privkey.pem",
+				tlsMinVersion:   c.minVersion,
+				tlsClientCaFile: c.clientCaFile,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual.MinVersion != c.expectedMinVersion {
+				t.Errorf("expected min version %x; but got: %x", c.expectedMinVersion, actual.MinVersion)
+			}
+			if actual.ClientAuth != c.expectedClientAuth {
+				t.Errorf("expected client auth %v; but got: %v", c.expectedClientAuth, actual.ClientAuth)
+			}
+			if (actual.ClientCAs != nil) != (c.clientCaFile != "") {
+				t.Errorf("expected client CAs only with a client CA file; but got: %v", actual.ClientCAs)
+			}
+			if cert, err := actual.GetCertificate(&tls.ClientHelloInfo{}); err != nil || !bytes.Equal(cert.Certificate[0], ca) {
+				t.Errorf("expected configured certificate; but got: %v", err)
+			}
+		})
+	}
+}
+
+func Test_newTlsConfig_failures(t *testing.T) {
+	dir := withTestSslDirectory(t)
+	writeTestCertificate(t, filepath.Join(dir, "fullchain.pem"), filepath.Join(dir, "privkey.pem"))
+	writeTestFile(t, filepath.Join(dir, "broken.pem"), []byte("broken"))
+
+	cases := []struct {
+		name          string
+		opt           options
+		expectedError string
+	}{
+		{"certOutside", options{certFile: "../fullchain.pem", keyFile: "privkey.pem"}, "illegal certfile"},
+		{"keyOutside", options{certFile: "fullchain.pem", keyFile: "/data/privkey.pem"}, "illegal keyfile"},
+		{"certMissing", options{certFile: "missing.pem", keyFile: "privkey.pem"}, "missing.pem"},
+		{"clientCaOutside", options{certFile: "fullchain.pem", keyFile: "privkey.pem", tlsClientCaFile: "../ca.pem"}, "illegal tls_client_ca_file"},
+		{"clientCaMissing", options{certFile: "fullchain.pem", keyFile: "privkey.pem", tlsClientCaFile: "ca.pem"}, "cannot read client CA file"},
+		{"clientCaBroken", options{certFile: "fullchain.pem", keyFile: "privkey.pem", tlsClientCaFile: "broken.pem"}, "does not contain any PEM encoded certificate"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := newTlsConfig(c.opt); err == nil || !strings.Contains(err.Error(), c.expectedError) {
+				t.Errorf("expected error containing %q; but got: %v", c.expectedError, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamAuthRefreshPath    = "/api/v1/auth/refresh"
+	ingressSessionCookie       = "ingress_session"
+	accessTokenRenewBefore     = time.Minute
+	accessTokenLifetimeDefault = 5 * time.Minute
+	accessTokenSessionTimeout  = 12 * time.Hour
+)
+
+func newAccessTokens(srv *server) *accessTokens {
+	return &accessTokens{
+		server:   srv,
+		sessions: map[string]*accessTokenSession{},
+		owners:   map[string]accessTokenOwner{},
+	}
+}
+
+// accessTokens obtains access tokens from Duplicati (using the PreAuth token)
+// and caches them per session of the ingress (or direct access). This ensures
+// that each browser session has its own token, instead of sharing one.
+//
+// Duplicati cannot limit what a token permits; so users which are not admin
+// only get a proxy-only token, which is worthless for Duplicati itself and
+// only replaced by the real one while their requests pass the wrapper (after
+// they were authorized).
+type accessTokens struct {
+	server *server
+
+	mutex    sync.Mutex
+	sessions map[string]*accessTokenSession
+	// owners contains the session for each token handed out.
+	owners map[string]accessTokenOwner
+}
+
+type accessTokenOwner struct {
+	key      string
+	upstream string
+}
+
+type accessTokenSession struct {
+	mutex          sync.Mutex
+	accessToken    string
+	publicToken    string
+	expires        time.Time
+	refreshCookies []*http.Cookie
+	lastUsed       time.Time
+}
+
+type accessTokenPayload struct {
+	AccessToken *string `json:"AccessToken"`
+}
+
+// sessionKeyOf identifies the session of the request via the session cookie of
+// the ingress (or the direct access) and the Home Assistant user.
+func sessionKeyOf(r *http.Request) string {
+	var session string
+	for _, name := range []string{ingressSessionCookie, directSessionCookie} {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			session = name + "=" + c.Value
+			break
+		}
+	}
+	id, name := userOf(r)
+	sum := sha256.Sum256([]byte(id + "\x00" + name + "\x00" + session))
+	return hex.EncodeToString(sum[:])
+}
+
+func (at *accessTokens) session(key string) *accessTokenSession {
+	now := time.Now()
+
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	for k, v := range at.sessions {
+		if k != key && now.Sub(v.lastUsed) > accessTokenSessionTimeout {
+			delete(at.owners, v.publicToken)
+			delete(at.sessions, k)
+		}
+	}
+	result, ok := at.sessions[key]
+	if !ok {
+		result = &accessTokenSession{}
+		at.sessions[key] = result
+	}
+	result.lastUsed = now
+	return result
+}
+
+// get returns a valid access token for the session of the given request. It
+// is renewed if it is about to expire. If scoped is true, the returned token is
+// a proxy-only one (see accessTokens).
+func (at *accessTokens) get(r *http.Request, scoped bool) (string, error) {
+	key := sessionKeyOf(r)
+	s := at.session(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	renewed := false
+	if s.accessToken == "" || time.Until(s.expires) <= accessTokenRenewBefore {
+		var token string
+		var err error
+		if len(s.refreshCookies) > 0 {
+			token, err = at.obtain(r.Context(), s, false)
+		}
+		if token == "" {
+			if token, err = at.obtain(r.Context(), s, true); err != nil {
+				return "", err
+			}
+		}
+		s.accessToken = token
+		s.expires = expiryOfJwt(token, time.Now().Add(accessTokenLifetimeDefault))
+		renewed = true
+	}
+
+	if renewed || s.publicToken == "" || scoped == (s.publicToken == s.accessToken) {
+		public := s.accessToken
+		if scoped {
+			var err error
+			if public, err = newProxyOnlyToken(s.expires); err != nil {
+				return "", err
+			}
+		}
+		at.mutex.Lock()
+		// The previous token of the session is replaced by the new one.
+		delete(at.owners, s.publicToken)
+		at.owners[public] = accessTokenOwner{key, s.accessToken}
+		at.mutex.Unlock()
+		s.publicToken = public
+	}
+	return s.publicToken, nil
+}
+
+// newProxyOnlyToken creates a token which looks like a JWT (so the GUI can
+// read when it expires) but is not signed by Duplicati.
+func newProxyOnlyToken(expires time.Time) (string, error) {
+	signature := make([]byte, 32)
+	if _, err := rand.Read(signature); err != nil {
+		return "", fmt.Errorf("cannot create proxy-only token: %w", err)
+	}
+	claims, err := json.Marshal(struct {
+		Exp int64  `json:"exp"`
+		Iss string `json:"iss"`
+	}{expires.Unix(), "wrapper"})
+	if err != nil {
+		return "", fmt.Errorf("cannot create proxy-only token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims) + "." +
+		base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// upstreamTokenOf returns the real access token behind the given token handed
+// out by us.
+func (at *accessTokens) upstreamTokenOf(token string) (string, bool) {
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	owner, ok := at.owners[token]
+	return owner.upstream, ok
+}
+
+// obtain requests a new access token from the upstream, either via the refresh
+// token of the session or via the PreAuth token.
+func (at *accessTokens) obtain(ctx context.Context, s *accessTokenSession, preAuth bool) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, at.server.upstreamUrl.String()+upstreamAuthRefreshPath, strings.NewReader("{}"))
+	if err != nil {
+		return "", fmt.Errorf("cannot create request to upstream: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIdFrom(ctx); id != "" {
+		req.Header.Set(requestIdHeader, id)
+	}
+	if preAuth {
+		req.Header.Set("Authorization", "PreAuth "+at.server.options.webservicePreAuthTokens)
+	} else {
+		for _, c := range s.refreshCookies {
+			req.AddCookie(c)
+		}
+	}
+
+	rsp, err := at.server.upstreamClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot request access token from upstream: %w", err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode != http.StatusOK {
+		if !preAuth {
+			s.refreshCookies = nil
+		}
+		return "", fmt.Errorf("cannot request access token from upstream: got %d - %s", rsp.StatusCode, rsp.Status)
+	}
+
+	var payload accessTokenPayload
+	if err := json.NewDecoder(rsp.Body).Decode(&payload); err != nil {
+		return "", fmt.Errorf("cannot decode access token of upstream: %w", err)
+	}
+	if payload.AccessToken == nil || *payload.AccessToken == "" {
+		return "", fmt.Errorf("upstream did not issue an access token")
+	}
+
+	// The refresh token is only kept by us and never handed out to the browser.
+	for _, c := range rsp.Cookies() {
+		s.refreshCookies = setCookieIn(s.refreshCookies, c)
+	}
+	return *payload.AccessToken, nil
+}
+
+// checkBinding ensures that an access token which was issued by us is only
+// used by the session it was issued for.
+func (at *accessTokens) checkBinding(r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if v := r.Header.Get("Authorization"); len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		token = strings.TrimSpace(v[7:])
+	}
+	if token == "" {
+		return nil
+	}
+
+	at.mutex.Lock()
+	owner, ok := at.owners[token]
+	at.mutex.Unlock()
+	if ok && owner.key != sessionKeyOf(r) {
+		return fmt.Errorf("access token was issued for another session")
+	}
+	return nil
+}
+
+// drop removes the token of the session of the given request.
+func (at *accessTokens) drop(r *http.Request) {
+	key := sessionKeyOf(r)
+
+	at.mutex.Lock()
+	defer at.mutex.Unlock()
+	if s, ok := at.sessions[key]; ok {
+		delete(at.owners, s.publicToken)
+		delete(at.sessions, key)
+	}
+}
+
+func setCookieIn(cookies []*http.Cookie, c *http.Cookie) []*http.Cookie {
+	result := cookies[:0]
+	for _, candidate := range cookies {
+		if candidate.Name != c.Name {
+			result = append(result, candidate)
+		}
+	}
+	if c.Value != "" && c.MaxAge >= 0 {
+		result = append(result, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return result
+}
+
+// expiryOfJwt reads the exp claim of the given token without validating it;
+// this is the job of the upstream.
+func expiryOfJwt(token string, def time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return def
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return def
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp <= 0 {
+		return def
+	}
+	return time.Unix(claims.Exp, 0)
+}
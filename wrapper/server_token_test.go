@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/echocat/slf4g"
+)
+
+// newTokenTestServer returns a server whose upstream issues a new (real)
+// access token for each request with the PreAuth token.
+func newTokenTestServer(t *testing.T) (*server, func(string) bool) {
+	var mutex sync.Mutex
+	issued := map[string]bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != upstreamAuthRefreshPath || r.Header.Get("Authorization") != "PreAuth secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		claims, _ := json.Marshal(map[string]int64{"exp": time.Now().Add(time.Hour).Unix()})
+		token := "header." + base64.RawURLEncoding.EncodeToString(claims) + ".signature" + strconv.Itoa(len(issued))
+		issued[token] = true
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(accessTokenPayload{AccessToken: &token})
+	}))
+	t.Cleanup(upstream.Close)
+
+	srv := &server{
+		options: options{
+			defaultRole:             roleViewer,
+			webservicePreAuthTokens: "secret",
+			accessControl: []optionsAccessControlEntry{
+				{User: "admin", Role: roleAdmin},
+			},
+		},
+		logger: log.GetLogger("test"),
+	}
+	var err error
+	if srv.upstreamUrl, err = url.Parse(upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+	srv.tokens = newAccessTokens(srv)
+	return srv, func(token string) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return issued[token]
+	}
+}
+
+func requestAccessToken(t *testing.T, srv *server, path, user string) string {
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/", nil)
+	r.URL.Path = path
+	r.Header.Set("X-Remote-User-Name", user)
+	r.AddCookie(&http.Cookie{Name: ingressSessionCookie, Value: "session-of-" + user})
+	rw := httptest.NewRecorder()
+	srv.handle(rw, r)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200; but got: %d", rw.Code)
+	}
+	var payload accessTokenPayload
+	if err := json.NewDecoder(rw.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.AccessToken == nil || *payload.AccessToken == "" {
+		t.Fatal("expected an access token; but got none")
+	}
+	return *payload.AccessToken
+}
+
+func Test_server_handlerAuthRefresh_viewerOnlyGetsProxyOnlyToken(t *testing.T) {
+	for _, path := range []string{"/api/v1/auth/refresh", "/API/v1/Auth/Refresh", "//api/v1/auth/refresh", "/api/v1/x/../auth/refresh"} {
+		t.Run(path, func(t *testing.T) {
+			srv, isIssuedByUpstream := newTokenTestServer(t)
+
+			token := requestAccessToken(t, srv, path, "viewer")
+
+			if isIssuedByUpstream(token) {
+				t.Errorf("expected viewer not to get a token which is valid for Duplicati; but got: %s", token)
+			}
+			if exp := expiryOfJwt(token, time.Time{}); time.Until(exp) < 30*time.Minute {
+				t.Errorf("expected proxy-only token to carry the expiry of the real one; but got: %v", exp)
+			}
+			if again := requestAccessToken(t, srv, path, "viewer"); again != token {
+				t.Errorf("expected token to be cached for the session; but got: %s", again)
+			}
+
+			// Inside the wrapper it still works: it is replaced by the real
+			// one before the (already authorized) request reaches Duplicati.
+			in := httptest.NewRequest(http.MethodGet, "http://localhost/api/v1/backup/1/log?token="+url.QueryEscape(token), nil)
+			pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+			srv.rewriteProxyRequest(pr)
+			if forwarded := pr.Out.URL.Query().Get("token"); !isIssuedByUpstream(forwarded) {
+				t.Errorf("expected proxy-only token to be replaced by the real one; but got: %s", forwarded)
+			}
+		})
+	}
+}
+
+func Test_server_handlerAuthRefresh_adminGetsRealToken(t *testing.T) {
+	srv, isIssuedByUpstream := newTokenTestServer(t)
+
+	token := requestAccessToken(t, srv, "/api/v1/auth/refresh", "admin")
+
+	if !isIssuedByUpstream(token) {
+		t.Errorf("expected admin to get the real token; but got: %s", token)
+	}
+}
+
+func Test_accessTokens_checkBinding(t *testing.T) {
+	srv, _ := newTokenTestServer(t)
+	token := requestAccessToken(t, srv, "/api/v1/auth/refresh", "viewer")
+
+	cases := []struct {
+		user     string
+		token    string
+		expected bool
+	}{
+		{"viewer", token, true},
+		{"other", token, false},
+		{"other", "unknown", true},
+		{"other", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.user+" "+c.token, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/api/v1/backups?token="+url.QueryEscape(c.token), nil)
+			r.Header.Set("X-Remote-User-Name", c.user)
+			r.AddCookie(&http.Cookie{Name: ingressSessionCookie, Value: "session-of-" + c.user})
+			if actual := srv.tokens.checkBinding(r) == nil; actual != c.expected {
+				t.Errorf("expected %v; but got: %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_accessTokens_get_renewalReplacesToken(t *testing.T) {
+	for _, user := range []string{"viewer", "admin"} {
+		t.Run(user, func(t *testing.T) {
+			srv, _ := newTokenTestServer(t)
+			tokens := []string{requestAccessToken(t, srv, "/api/v1/auth/refresh", user)}
+
+			for i := 0; i < 2; i++ {
+				// Let the token of the session be about to expire.
+				for _, s := range srv.tokens.sessions {
+					s.expires = time.Now()
+				}
+				tokens = append(tokens, requestAccessToken(t, srv, "/api/v1/auth/refresh", user))
+			}
+
+			if actual := len(srv.tokens.owners); actual != 1 {
+				t.Errorf("expected only the current token to be known; but got: %d", actual)
+			}
+			for i, token := range tokens[:len(tokens)-1] {
+				if token == tokens[len(tokens)-1] {
+					t.Fatalf("expected token %d to be renewed; but it was not", i)
+				}
+				if upstream, ok := srv.tokens.upstreamTokenOf(token); ok {
+					t.Errorf("expected replaced token %d not to resolve anymore; but got: %s", i, upstream)
+				}
+			}
+			if _, ok := srv.tokens.upstreamTokenOf(tokens[len(tokens)-1]); !ok {
+				t.Errorf("expected current token to resolve")
+			}
+		})
+	}
+}
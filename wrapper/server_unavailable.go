@@ -0,0 +1,147 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	unavailableRetryAfterSeconds = 5
+	unavailableLogLines          = 10
+)
+
+type unavailableReason string
+
+const (
+	unavailableReasonStarting    unavailableReason = "starting"
+	unavailableReasonRestarting  unavailableReason = "restarting"
+	unavailableReasonCrashed     unavailableReason = "crashed"
+	unavailableReasonUnreachable unavailableReason = "unreachable"
+)
+
+func (r unavailableReason) status() int {
+	switch r {
+	case unavailableReasonStarting, unavailableReasonRestarting:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func (r unavailableReason) title() string {
+	switch r {
+	case unavailableReasonStarting:
+		return "Duplicati is starting..."
+	case unavailableReasonRestarting:
+		return "Duplicati is restarting..."
+	case unavailableReasonCrashed:
+		return "Duplicati has stopped"
+	default:
+		return "Duplicati is not reachable"
+	}
+}
+
+func (r unavailableReason) description() string {
+	switch r {
+	case unavailableReasonStarting:
+		return "Duplicati is still starting up. This can take a while, for example if its database needs to be migrated."
+	case unavailableReasonRestarting:
+		return "Duplicati was available before but does currently not accept connections. It will probably be back in a moment."
+	case unavailableReasonCrashed:
+		return "The Duplicati process is no longer running. Check the add-on logs for details; the add-on will be restarted by the Supervisor if the watchdog is enabled."
+	default:
+		return "The wrapper could not talk to Duplicati."
+	}
+}
+
+type unavailablePayload struct {
+	Error       string            `json:"Error"`
+	Reason      unavailableReason `json:"Reason"`
+	Title       string            `json:"-"`
+	Description string            `json:"Description"`
+	ExitCode    *int              `json:"ExitCode,omitempty"`
+	Logs        []string          `json:"Logs,omitempty"`
+	RetryAfter  int               `json:"RetryAfter"`
+	RequestId   string            `json:"RequestId,omitempty"`
+}
+
+var (
+	//go:embed server_unavailable.html
+	unavailablePageHtml string
+
+	unavailablePageTemplate = template.Must(template.New("unavailable").Parse(unavailablePageHtml))
+)
+
+func (srv *server) unavailableReasonOf(err error) unavailableReason {
+	switch srv.state.getPhase() {
+	case processPhaseStarting:
+		return unavailableReasonStarting
+	case processPhaseExited, processPhaseFailed:
+		return unavailableReasonCrashed
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		if srv.upstreamWasReady.Load() {
+			return unavailableReasonRestarting
+		}
+		return unavailableReasonStarting
+	}
+	return unavailableReasonUnreachable
+}
+
+func (srv *server) serveUnavailable(rw http.ResponseWriter, r *http.Request, err error) {
+	reason := srv.unavailableReasonOf(err)
+	snapshot := srv.state.snapshot()
+
+	payload := unavailablePayload{
+		Error:       reason.title(),
+		Reason:      reason,
+		Title:       reason.title(),
+		Description: reason.description(),
+		RetryAfter:  unavailableRetryAfterSeconds,
+		RequestId:   requestIdOf(r),
+	}
+	// The logs of Duplicati and the errors of the wrapper can reveal more
+	// (like paths or hosts of backups) than users which are not admin see.
+	if srv.roleOf(r).permits(roleAdmin) {
+		payload.ExitCode = snapshot.ExitCode
+		payload.Logs = srv.state.logs.get(unavailableLogLines)
+		if err != nil {
+			payload.Error = logRedactor.redact(err.Error())
+		}
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(unavailableRetryAfterSeconds))
+	rw.Header().Set("Cache-Control", "no-store")
+	if wantsJson(r) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(reason.status())
+		if r.Method == http.MethodHead {
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(payload)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.WriteHeader(reason.status())
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := unavailablePageTemplate.Execute(rw, payload); err != nil {
+		srv.loggerOf(r).WithError(err).Warn("cannot render unavailable page")
+	}
+}
+
+func wantsJson(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/echocat/slf4g"
+)
+
+func Test_server_serveUnavailable(t *testing.T) {
+	withTestSecrets(t)
+	st := newState()
+	st.setRunning(1)
+	st.setExited(134, nil)
+	_, _ = st.logs.Write([]byte("Authorization: PreAuth " + testSecretPreAuth + "\nduplicati log line\n"))
+	srv := &server{
+		options: options{
+			defaultRole: roleViewer,
+			accessControl: []optionsAccessControlEntry{
+				{User: "admin", Role: roleAdmin},
+			},
+		},
+		logger: log.GetLogger("test"),
+		state:  st,
+	}
+	upstreamErr := errors.New("dial tcp: cannot connect with password " + testSecretPassword)
+
+	cases := []struct {
+		user            string
+		expectedDetails bool
+	}{
+		{"admin", true},
+		{"viewer", false},
+	}
+	for _, c := range cases {
+		t.Run(c.user, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://localhost/api/v1/backups", nil)
+			r.Header.Set("X-Remote-User-Name", c.user)
+			rw := httptest.NewRecorder()
+
+			srv.serveUnavailable(rw, r, upstreamErr)
+
+			if rw.Code != http.StatusBadGateway {
+				t.Errorf("expected status 502; but got: %d", rw.Code)
+			}
+			var payload unavailablePayload
+			if err := json.NewDecoder(rw.Body).Decode(&payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Reason != unavailableReasonCrashed {
+				t.Errorf("expected reason %q; but got: %q", unavailableReasonCrashed, payload.Reason)
+			}
+			if c.expectedDetails {
+				if payload.ExitCode == nil || *payload.ExitCode != 134 {
+					t.Errorf("expected exit code 134; but got: %v", payload.ExitCode)
+				}
+				if len(payload.Logs) != 2 {
+					t.Errorf("expected logs; but got: %v", payload.Logs)
+				}
+				if !strings.Contains(payload.Error, "dial tcp") {
+					t.Errorf("expected error of upstream; but got: %s", payload.Error)
+				}
+				assertNoTestSecrets(t, payload.Error+"\n"+strings.Join(payload.Logs, "\n"))
+			} else {
+				if payload.ExitCode != nil || len(payload.Logs) > 0 {
+					t.Errorf("expected no details; but got: %+v", payload)
+				}
+				if payload.Error != unavailableReasonCrashed.title() {
+					t.Errorf("expected generic error; but got: %s", payload.Error)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type processPhase string
+
+const (
+	processPhaseStarting processPhase = "starting"
+	processPhaseRunning  processPhase = "running"
+	processPhaseExited   processPhase = "exited"
+	processPhaseFailed   processPhase = "failed"
+)
+
+func newState() *state {
+	return &state{
+		phase: processPhaseStarting,
+		logs:  newLogTail(logTailLinesDefault),
+	}
+}
+
+type state struct {
+	mutex sync.RWMutex
+
+	phase     processPhase
+	pid       int
+	startedAt time.Time
+	exitedAt  time.Time
+	exitCode  *int
+	release   string
+
+	lastError   error
+	lastErrorAt time.Time
+
+	logs *logTail
+}
+
+type stateSnapshot struct {
+	Phase     processPhase        `json:"phase"`
+	Pid       int                 `json:"pid,omitempty"`
+	StartedAt *time.Time          `json:"startedAt,omitempty"`
+	ExitedAt  *time.Time          `json:"exitedAt,omitempty"`
+	ExitCode  *int                `json:"exitCode,omitempty"`
+	Release   string              `json:"release,omitempty"`
+	LastError *stateSnapshotError `json:"lastError,omitempty"`
+}
+
+type stateSnapshotError struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+func (s *state) setRunning(pid int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.phase = processPhaseRunning
+	s.pid = pid
+	s.startedAt = time.Now()
+}
+
+func (s *state) setExited(exitCode int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.phase = processPhaseExited
+	s.exitedAt = time.Now()
+	s.exitCode = &exitCode
+	if err != nil {
+		s.lastError, s.lastErrorAt = err, s.exitedAt
+	}
+}
+
+func (s *state) setFailed(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.phase = processPhaseFailed
+	s.lastError, s.lastErrorAt = err, time.Now()
+}
+
+func (s *state) recordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastError, s.lastErrorAt = err, time.Now()
+}
+
+// setRelease records the identity of the Duplicati release which is used.
+func (s *state) setRelease(v string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.release = v
+}
+
+func (s *state) getRelease() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.release
+}
+
+func (s *state) getPhase() processPhase {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.phase
+}
+
+func (s *state) snapshot() (result stateSnapshot) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	result.Phase = s.phase
+	result.Pid = s.pid
+	result.Release = s.release
+	if !s.startedAt.IsZero() {
+		v := s.startedAt
+		result.StartedAt = &v
+	}
+	if !s.exitedAt.IsZero() {
+		v := s.exitedAt
+		result.ExitedAt = &v
+	}
+	if s.exitCode != nil {
+		v := *s.exitCode
+		result.ExitCode = &v
+	}
+	if s.lastError != nil {
+		result.LastError = &stateSnapshotError{
+			Message: logRedactor.redact(s.lastError.Error()),
+			At:      s.lastErrorAt,
+		}
+	}
+	return result
+}
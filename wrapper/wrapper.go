@@ -1,32 +1,48 @@
 package main
 
 import (
+	"context"
 	"os"
+	"sync"
+	"syscall"
 )
 
 func newWrapper(opt options) (result *wrapper, err error) {
-	srv, err := newServer(opt)
-	if err != nil {
-		return nil, err
-	}
-	proc, err := newProcess(opt)
+	st := newState()
+	srv, err := newServer(opt, st)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	result = &wrapper{
+		options: opt,
 		server:  srv,
-		process: proc,
+		state:   st,
+		ctx:     ctx,
+		cancel:  cancel,
+		stopped: make(chan struct{}),
 	}
 
 	return result, nil
 }
 
 type wrapper struct {
+	options options
 	server  *server
-	process *process
+	state   *state
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mutex    sync.Mutex
+	process  *process
+	stopping bool
+	stopped  chan struct{}
 }
 
+// run serves before the process is started, because downloading and
+// validating a custom release can take a while; health, readiness and the
+// starting page have to answer in the meantime.
 func (w *wrapper) run() (int, error) {
 	go func() {
 		if err := w.server.serve(); err != nil {
@@ -35,19 +51,80 @@ func (w *wrapper) run() (int, error) {
 		}
 	}()
 
-	return w.process.wait()
+	proc, err := newProcess(w.ctx, w.options, w.state)
+	if err != nil {
+		if w.ctx.Err() != nil {
+			w.server.logger.Info("stopped before duplicati was started")
+			return 0, nil
+		}
+		// The failure stays visible (and the health endpoint reports it),
+		// until we get stopped, for example by the watchdog.
+		w.state.setFailed(err)
+		w.server.logger.WithError(err).Error("cannot start duplicati")
+		<-w.stopped
+		return 1, err
+	}
+
+	w.mutex.Lock()
+	w.process = proc
+	stopping := w.stopping
+	w.mutex.Unlock()
+	if stopping {
+		proc.signal(syscall.SIGTERM)
+	}
+
+	ec, err := proc.wait()
+	w.mutex.Lock()
+	stopping = w.stopping
+	w.mutex.Unlock()
+	if stopping {
+		return ec, err
+	}
+
+	// The process stopped on its own. Like above, this stays visible (on the
+	// unavailable page and the health endpoint), until we get stopped.
+	logger := w.server.logger.With("exitCode", ec)
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Error("duplicati stopped unexpectedly")
+	<-w.stopped
+	return ec, err
+}
+
+// signal forwards the given signal to the process. Terminating signals also
+// stop the wrapper itself and cancel whatever newProcess is doing.
+func (w *wrapper) signal(sig os.Signal) {
+	w.mutex.Lock()
+	proc := w.process
+	if (sig == syscall.SIGTERM || sig == os.Interrupt) && !w.stopping {
+		w.stopping = true
+		close(w.stopped)
+		w.cancel()
+	}
+	w.mutex.Unlock()
+
+	if proc != nil {
+		proc.signal(sig)
+	}
 }
 
 func (w *wrapper) Close() (rErr error) {
+	w.cancel()
 	defer func() {
 		if err := w.server.Close(); err != nil && rErr == nil {
 			rErr = err
 		}
 	}()
-	defer func() {
-		if err := w.process.Close(); err != nil && rErr == nil {
-			rErr = err
-		}
-	}()
+	w.mutex.Lock()
+	proc := w.process
+	w.mutex.Unlock()
+	if proc != nil {
+		defer func() {
+			if err := proc.Close(); err != nil && rErr == nil {
+				rErr = err
+			}
+		}()
+	}
 	return nil
 }